@@ -0,0 +1,85 @@
+// Export mode: secrets are resolved like for the command, but printed in one of secretsexport formats instead,
+// e.g. for eval in shell scripts, docker --env-file or kubectl apply.
+package main
+
+import (
+	"flag"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+	"secretsexport"
+)
+
+var (
+	exportFormat    = flag.String("format", secretsexport.FormatDotenv, "export: output format, one of "+strings.Join(secretsexport.Formats(), ", "))
+	exportOutput    = flag.String("output", "", "export: write to this file (mode 0600) instead of stdout")
+	exportName      = flag.String("secret-name", "", "export: name of the Kubernetes Secret, for format "+secretsexport.FormatKubernetesSecret)
+	exportNamespace = flag.String("secret-namespace", "", "export: namespace of the Kubernetes Secret, for format "+secretsexport.FormatKubernetesSecret)
+)
+
+// Resolves the chain and prints the secrets, exits non-zero without output if the fail policy says so
+func runExport() {
+	policy, err := failPolicyOf()
+	if err != nil {
+		log.Fatalf("%s %v", logPrefix, err)
+	}
+	chain, err := secretschain.NewSecretChain()
+	if err != nil {
+		log.Fatalf("%s unable to generate secrets chain: %v", logPrefix, err)
+	}
+	if err := chain.Resolve(); err != nil {
+		log.Errorf("%s %v", logPrefix, err)
+	}
+	failed := len(chain.Failed())
+	if policyFailed(policy, len(chain.Secrets), failed) {
+		log.Fatalf("%s %d of %d secrets failed, nothing is exported", logPrefix, failed, len(chain.Secrets))
+	}
+
+	values, errs := chain.Environment()
+	for _, err := range errs {
+		log.Errorf("%s unable to export env variable: %v", logPrefix, err)
+	}
+	addFileValues(chain, values, *exportFormat)
+	warnUnmanagedLeases(chain)
+
+	out, err := secretsexport.Format(*exportFormat, values, secretsexport.Options{Name: *exportName, Namespace: *exportNamespace})
+	if err != nil {
+		log.Fatalf("%s %v", logPrefix, err)
+	}
+	if *exportOutput == "" || *exportOutput == "-" {
+		_, err = os.Stdout.Write(out)
+	} else {
+		err = secretsexport.WriteFile(*exportOutput, out, 0600)
+	}
+	if err != nil {
+		log.Fatalf("%s unable to write export: %v", logPrefix, err)
+	}
+	log.Infof("%s exported %d values as %s, %d secrets failed", logPrefix, len(values), *exportFormat, failed)
+}
+
+// adds file secrets to values under their file names, for formats which aren't env variables (JSON, Kubernetes Secret)
+func addFileValues(chain *secretschain.SecretChainStruct, values map[string]string, format string) {
+	for idx := range chain.Secrets {
+		s := &chain.Secrets[idx]
+		if s.Err != nil {
+			continue
+		}
+		for name, f := range secretFiles(s) {
+			key := path.Base(name)
+			_, taken := values[key]
+			switch {
+			case format == secretsexport.FormatDotenv || format == secretsexport.FormatDockerEnv || format == secretsexport.FormatShell:
+				log.Warningf("%s secret file %s is not exported as %s, use %s or %s", logPrefix, name, format,
+					secretsexport.FormatJSON, secretsexport.FormatKubernetesSecret)
+			case taken:
+				log.Warningf("%s secret file %s is not exported, key %s is taken", logPrefix, name, key)
+			default:
+				values[key] = f.content
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Fetch-only mode: secret-injector runs as init container, writes secret files (and optionally dotenv file of
+// env secrets) to a volume shared with the application, reports a summary and exits, e.g. for images whose
+// entrypoint can't be wrapped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+	"secretsexport"
+	secinject "secretsinjector"
+	"utils"
+)
+
+const (
+	dotenvFileVarName = "SECRET_INJECTOR_DOTENV_FILE"
+	dotenvModeVarName = "SECRET_INJECTOR_DOTENV_MODE"
+	defaultDotenvMode = 0400 // owner only, like private keys: unlike a secret file it holds every env secret at once
+	failPolicyVarName = "SECRET_INJECTOR_FAIL_POLICY"
+	failPolicyAny     = "any"   // exit non-zero if any secret failed (default)
+	failPolicyAll     = "all"   // exit non-zero only if every secret failed
+	failPolicyNever   = "never" // always exit 0
+)
+
+var (
+	dotenvFile = flag.String("dotenv-file", "", "fetch: write env secrets to this dotenv file, same as env variable "+dotenvFileVarName)
+	dotenvMode = flag.String("dotenv-mode", "", "fetch: octal permission mask of the dotenv file, default 0400 or env variable "+dotenvModeVarName)
+	failPolicy = flag.String("fail-policy", "", "fetch, export: exit non-zero if 'any' (default) or 'all' secrets failed, or 'never', same as env variable "+failPolicyVarName)
+)
+
+// Resolves the chain, writes secret files and exits with code according to the fail policy
+func runFetch() {
+	policy, err := failPolicyOf()
+	if err != nil {
+		log.Fatalf("%s %v", logPrefix, err)
+	}
+	dotenv := *dotenvFile
+	if dotenv == "" {
+		dotenv = utils.GetEnvVariableByName(dotenvFileVarName)
+	}
+	mode, err := dotenvModeOf()
+	if err != nil {
+		log.Fatalf("%s %v", logPrefix, err)
+	}
+
+	chain, err := secretschain.NewSecretChain()
+	if err != nil {
+		log.Fatalf("%s unable to generate secrets chain: %v", logPrefix, err)
+	}
+	if err := chain.Resolve(); err != nil {
+		log.Errorf("%s %v", logPrefix, err)
+	}
+
+	failed := make(map[string]bool) // name@origin of failed secrets
+	for _, s := range chain.Failed() {
+		failed[s.Name+"@"+s.Origin] = true
+	}
+	files := 0
+	for idx := range chain.Secrets {
+		s := &chain.Secrets[idx]
+		if s.Err != nil {
+			continue
+		}
+		if err := generateSecretFiles(s); err != nil {
+			log.Errorf("%s unable to generate secrets file: %v", logPrefix, err)
+			failed[s.Name+"@"+s.Origin] = true
+			continue
+		}
+		files += len(secretFiles(s))
+	}
+
+	env, errs := chain.Environment()
+	for _, err := range errs {
+		log.Errorf("%s unable to set env variable: %v", logPrefix, err)
+	}
+	switch {
+	case dotenv != "":
+		if err := secretsexport.WriteFile(dotenv, secretsexport.Dotenv(env), mode); err != nil {
+			log.Errorf("%s unable to write dotenv file %s: %v", logPrefix, dotenv, err)
+			for idx := range chain.Secrets {
+				s := &chain.Secrets[idx]
+				if _, expand := s.Options[secretschain.OptionExpand]; s.Err == nil && (s.EnvVar != "" || expand) {
+					failed[s.Name+"@"+s.Origin] = true
+				}
+			}
+		}
+	case len(env) > 0:
+		log.Warningf("%s %d env variables are not written, set -dotenv-file or %s", logPrefix, len(env), dotenvFileVarName)
+	}
+	warnUnmanagedLeases(chain)
+
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Infof("%s fetched %d secrets: %d files written, %d env variables written to '%s', %d failed %v",
+		logPrefix, len(chain.Secrets), files, len(env), dotenv, len(failed), names)
+	if policyFailed(policy, len(chain.Secrets), len(failed)) {
+		os.Exit(1)
+	}
+}
+
+// returns fail policy of fetch and export modes
+func failPolicyOf() (string, error) {
+	policy := *failPolicy
+	if policy == "" {
+		policy = utils.GetEnvVariableByName(failPolicyVarName)
+	}
+	switch policy = strings.ToLower(policy); policy {
+	case "":
+		return failPolicyAny, nil
+	case failPolicyAny, failPolicyAll, failPolicyNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown fail policy %s, expected %s, %s or %s", policy, failPolicyAny, failPolicyAll, failPolicyNever)
+}
+
+// returns permission mask of the dotenv file, e.g. 0440 when the application runs as another user of the same group
+func dotenvModeOf() (os.FileMode, error) {
+	mode := *dotenvMode
+	if mode == "" {
+		mode = utils.GetEnvVariableByName(dotenvModeVarName)
+	}
+	if mode == "" {
+		return defaultDotenvMode, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m == 0 || m > 0777 {
+		return 0, fmt.Errorf("invalid mode %s of the dotenv file, expected octal permission mask like 0440", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// reports whether the fetch failed according to the policy
+func policyFailed(policy string, total, failed int) bool {
+	switch policy {
+	case failPolicyNever:
+		return false
+	case failPolicyAll:
+		return total > 0 && failed == total
+	}
+	return failed > 0
+}
+
+// warns about leases of dynamic secrets, which outlive secret-injector: nobody renews nor revokes them
+func warnUnmanagedLeases(chain *secretschain.SecretChainStruct) {
+	if hc, ok := chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct); ok && hc.Leases != nil {
+		for _, l := range hc.Leases.Leases() {
+			if l.LeaseID == "" {
+				continue // e.g. certificate, nothing to renew nor revoke
+			}
+			log.Warningf("%s lease of %s will not be renewed nor revoked, it expires in %ds (see -supervise)", logPrefix, l.Name, l.Duration)
+		}
+	}
+}
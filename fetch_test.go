@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"secretschain"
+)
+
+func TestDotenvModeOf(t *testing.T) {
+	t.Log("Testing permission mask of the dotenv file")
+	cases := map[string]os.FileMode{"": defaultDotenvMode, "0440": 0440, "644": 0644}
+	for value, expected := range cases {
+		os.Setenv(dotenvModeVarName, value)
+		if mode, err := dotenvModeOf(); err != nil || mode != expected {
+			t.Errorf("%q: expected %o, got %o (%v)", value, expected, mode, err)
+		}
+	}
+	for _, value := range []string{"rw-r-----", "0", "01777"} {
+		os.Setenv(dotenvModeVarName, value)
+		if _, err := dotenvModeOf(); err == nil {
+			t.Errorf("%q: invalid mode should fail", value)
+		}
+	}
+	os.Unsetenv(dotenvModeVarName)
+}
+
+func TestGenerateSecretFilesModes(t *testing.T) {
+	t.Log("Testing secret files are written with their permission mask")
+	dir, err := ioutil.TempDir("", "secret-injector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &secretschain.SecretStruct{
+		FilePath: dir + "/tls/",
+		Values:   map[string]string{"tls.crt": "cert", "tls.key": "key"},
+		Modes:    map[string]os.FileMode{"tls.key": 0400},
+	}
+	for i := 0; i < 2; i++ { // existing read-only files are replaced
+		if err := generateSecretFiles(s); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for name, expected := range map[string]os.FileMode{"tls.crt": 0444, "tls.key": 0400} {
+		fi, err := os.Stat(filepath.Join(dir, "tls", name))
+		if err != nil || fi.Mode().Perm() != expected {
+			t.Errorf("%s: expected mode %o, got %v (%v)", name, expected, fi, err)
+		}
+	}
+}
@@ -3,27 +3,37 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"flag"
 	"fmt"
 	"github.com/spf13/viper"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"strings"
 	"syscall"
-	"encoding/json"
 
 	log "github.com/sirupsen/logrus"
 
-	secinject "secretsinjector"
+	hcvault "hc_vault_k8s"
+	secinject "secretsinjector" // also registers secret providers
 	"utils"
 	"secretschain"
+	"secretsexport"
+	"secretsync"
+	"webhook"
 )
 const (
 		logPrefix = "secret-injector:"
+		defaultSecretFileMode = 0444 // read-only, secret files are often read by the application running as another user
 )
 var (
 	Secrets map[string]string // key = environment secret name, value = vault secret name
+
+	manifestPath = flag.String("manifest", "", "path to YAML/JSON secrets manifest, overrides env variable "+secretschain.ManifestEnvVarName)
+	insecure     = flag.Bool("insecure-skip-tls-verify", false, "do not verify TLS certificate of Vault, for local development only")
+	offline      = flag.Bool("offline", false, "resolve vault references from local file, same as env variable "+secinject.OfflineVarName+"=true")
 )
 
 //------------------------------------------------------------------------------
@@ -48,10 +58,10 @@ func initHCVault(){
 	}
 	setIfNotSet("VAULT_TOKEN_PATH", "/home/vault/.vault-token")
 	setIfNotSet("VAULT_REAUTH", "true")
-	setIfNotSet("VAULT_AUTH_MOUNT_PATH", "kubernetes")
-	setIfNotSet("SERVICE_ACCOUNT_TOKEN_PATH", "kubernetes")
+	if method := utils.GetEnvVariableByName("VAULT_AUTH_METHOD"); method == "" || strings.EqualFold(method, "kubernetes") {
+		setIfNotSet("VAULT_AUTH_MOUNT_PATH", "kubernetes") // other methods default to their own mount, e.g. auth/approle
+	}
 	setIfNotSet("SERVICE_ACCOUNT_TOKEN_PATH", "/var/run/secrets/kubernetes.io/serviceaccount/token")
-	setIfNotSet("VAULT_SKIP_VERIFY", "true")
 	viper.AutomaticEnv()
 }
 // Injector init
@@ -89,51 +99,88 @@ func init() {
 
 func main() {
 
-	chain, err := secretschain.NewSecretChain() //
-	if err != nil {
-		log.Errorf("%s unable to generate secrets chain:  %v", logPrefix, err.Error())
+	// flags go before the command, e.g. secret-injector -manifest /etc/injector/secrets.yaml /my-app --my-flag
+	flag.Parse()
+	args := flag.Args()
+	if *manifestPath != "" {
+		_ = os.Setenv(secretschain.ManifestEnvVarName, *manifestPath)
 	}
 
-	// Azure KeyVault
-	_, err = secinject.NewAzKVault(chain)
-	if err != nil {
-		log.Errorf("%s unable to generate secrets chain:  %v", logPrefix, err.Error())
+	// subcommands
+	if len(args) > 0 && args[0] == "webhook" {
+		runWebhook()
+		return
+	}
+	if len(args) > 0 && args[0] == "controller" {
+		runController()
+		return
 	}
 
-	// HC Vault
-	hc, err := secinject.NewHashicorpVaultClient(chain)
+	hcvault.InsecureSkipVerify = *insecure
+	// developer laptops and CI: vault references come from local file
+	secinject.ConfigureOffline(*offline || secinject.IsOffline())
+
+	if len(args) > 0 && args[0] == "sidecar" {
+		runSidecar()
+		return
+	}
+	if len(args) > 0 && args[0] == "fetch" {
+		runFetch()
+		return
+	}
+	if len(args) > 0 && args[0] == "export" {
+		runExport()
+		return
+	}
+
+	chain, err := secretschain.NewSecretChain() //
 	if err != nil {
 		log.Errorf("%s unable to generate secrets chain:  %v", logPrefix, err.Error())
 	}
-	prettyJSON, _ := json.MarshalIndent(hc.Chain, "", "    ") ; fmt.Printf("%s\n", string(prettyJSON))
+
+	// retrieve the secrets, each from its own provider (see secretsinjector for the list)
+	if err = chain.Resolve(); err != nil {
+		log.Errorf("%s %v", logPrefix, err.Error())
+	}
+	for _, s := range chain.Secrets { // names only, values never reach the logs
+		log.Debugf("%s secret %s%s@%s resolved: %t", logPrefix, s.VaultPath, s.Name, s.Origin, s.Err == nil)
+	}
 
 	// Now, set Env Vars with secrets and files
 	// set secrets as  env vars
-	for idx, _ := range chain.Secrets {
-		if chain.Secrets[idx].EnvVar != "" {
-			_ = os.Setenv(chain.Secrets[idx].EnvVar , chain.Secrets[idx].Secret)
+	env, errs := chain.Environment()
+	for _, err := range errs {
+		log.Errorf("%s unable to set env variable:  %v", logPrefix, err.Error())
+	}
+	for name, value := range env {
+		_ = os.Setenv(name, value)
+	}
+	for _, s := range chain.Failed() { // the application gets empty value instead of the reference
+		if s.EnvVar != "" {
+			_ = os.Setenv(s.EnvVar, "")
 		}
 	}
 	// generate secret files
 	for idx, _ := range chain.Secrets { // iterate through all files we came know of
-		if chain.Secrets[idx].FilePath != "" {
-			err := generateSecretsFile(chain.Secrets[idx].FilePath + chain.Secrets[idx].Name, "", chain.Secrets[idx].Secret)
-			if err != nil {
-				log.Errorf("%s unable to generate secrets file:  %v", logPrefix, err.Error())
-			}
+		if err := generateSecretFiles(&chain.Secrets[idx]); err != nil {
+			log.Errorf("%s unable to generate secrets file:  %v", logPrefix, err.Error())
 		}
 	}
 
 	// ..and the final part to call the command
-	if len(os.Args) == 1 {
-		log.Fatalf("%s no command is given, currently vault-env can't determine the entrypoint (command), please specify it explicitly", logPrefix)
+	if len(args) == 0 {
+		log.Fatalf("%s no command is given, currently vault-env can't determine the entrypoint (command), please specify it explicitly or use 'fetch' to write secret files only", logPrefix)
 	} else {
-		binary, err := exec.LookPath(os.Args[1])
+		binary, err := exec.LookPath(args[0])
 		if err != nil {
-			log.Errorf("%s binary not found: %s", logPrefix, os.Args[1])
+			log.Errorf("%s binary not found: %s", logPrefix, args[0])
+		}
+		if superviseMode() { // child process, exits with its exit code
+			runSupervised(chain, binary, args)
 		}
-		log.Infof("starting process %s %v", binary, os.Args[1:])
-		err = syscall.Exec(binary, os.Args[1:], os.Environ())
+		warnUnmanagedLeases(chain) // exec replaces this process, nobody is left to renew or revoke
+		log.Infof("starting process %s %v", binary, args)
+		err = syscall.Exec(binary, args, os.Environ())
 		if err != nil {
 			log.Errorf("%s failed to exec process '%s': %s", logPrefix, binary, err.Error())
 			return
@@ -145,46 +192,80 @@ func main() {
 }
 
 
+// Runs mutating admission webhook server, which injects secret-injector into pods
+func runWebhook() {
+	log.Infof("%s starting mutating admission webhook", logPrefix)
+	if err := webhook.NewServer(webhook.NewConfigFromEnvironment()).ListenAndServeTLS(); err != nil {
+		log.Fatalf("%s webhook server failed: %v", logPrefix, err.Error())
+	}
+}
+
+// Runs controller, which syncs SecretSync resources into Kubernetes Secrets, until SIGTERM
+func runController() {
+	hcvault.InsecureSkipVerify = *insecure
+	c, err := secretsync.NewFromEnvironment()
+	if err != nil {
+		log.Fatalf("%s %v", logPrefix, err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	log.Infof("%s starting secret sync controller", logPrefix)
+	if err := c.Run(ctx); err != nil {
+		log.Fatalf("%s secret sync controller failed: %v", logPrefix, err.Error())
+	}
+}
 
 //
-// Function  creates secrets file, writes secret to it and makes file read-only
+// Function creates secret file(s) of the secret: one file per key if secret has many values, otherwise single file
 //
-func generateSecretsFile(mntPath, secName, secret string) error {
-	var secretsFile string
-	if secName != "" {
-		secretsFile = mntPath + "/" + secName
-	}else{
-		secretsFile = mntPath
-	}
-	_, err := os.Create(secretsFile)
-	if err != nil {
-		s := fmt.Sprintf("Error creating the file %s: %v", secretsFile, err.Error())
-		return errors.New(s)
-	} else {
-		log.Debugf("Creating secret file: %s", secretsFile)
-		_, err := os.Stat(secretsFile)
-		if err != nil {
-			if os.IsNotExist(err) {
-				s := fmt.Sprintf("File %s does not exist.", secretsFile)
-				return errors.New(s)
-			}
-		} else {
-			// write secret to secrtets file
-			log.Debugf("Populating secrets file: %s", secretsFile)
-			err := ioutil.WriteFile(secretsFile, []byte(secret), 0666)
-			if err != nil {
-				s := fmt.Sprintf("Can't write to the file: %v", err.Error())
-				return errors.New(s)
-			}
+func generateSecretFiles(s *secretschain.SecretStruct) error {
+	for name, f := range secretFiles(s) {
+		mode := f.mode
+		if mode == 0 {
+			mode = defaultSecretFileMode
 		}
-		//make file read-only
-		log.Debugf("Making secrets file: %s read-only", secretsFile)
-		err = os.Chmod(secretsFile, 0444)
-		if err != nil {
-			s := fmt.Sprintf("Can't file's permission mask: %v", err.Error())
-			return errors.New(s)
+		// created with its final mode, so keys are never readable by others, not even for a moment
+		log.Debugf("Creating secret file: %s (%o)", name, mode)
+		if err := secretsexport.WriteFile(name, []byte(f.content), mode); err != nil {
+			return fmt.Errorf("unable to write secret file %s: %v", name, err)
 		}
-
 	}
 	return nil
 }
+
+// secret file, mode 0 means default
+type secretFile struct {
+	content string
+	mode    os.FileMode
+}
+
+//
+// Function returns files of the secret: full path -> content and mode
+//
+func secretFiles(s *secretschain.SecretStruct) map[string]secretFile {
+	files := make(map[string]secretFile)
+	if s.FilePath == "" {
+		return files
+	}
+	if s.Values == nil {
+		files[s.FilePath + s.File] = secretFile{s.Secret, s.Mode}
+		return files
+	}
+	for key, value := range s.Values {
+		name := path.Clean("/" + key)[1:] // keys must not escape the mount path
+		if name == "" {
+			continue
+		}
+		mode := s.Mode
+		if m, ok := s.Modes[key]; ok {
+			mode = m
+		}
+		files[s.FilePath + name] = secretFile{value, mode}
+	}
+	return files
+}
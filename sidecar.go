@@ -0,0 +1,387 @@
+// Sidecar mode: secret-injector keeps running next to the application and keeps secret files fresh.
+// Secrets are re-resolved on an interval, dynamic secrets and certificates when their lease expires; changed files are
+// rewritten atomically and the application is notified with a signal, an HTTP call or a command.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	hcvault "hc_vault_k8s"
+	"secretschain"
+	"secretsexport"
+	secinject "secretsinjector"
+	"utils"
+)
+
+const (
+	refreshIntervalVarName = "SECRET_INJECTOR_REFRESH_INTERVAL"
+	probeAddrVarName       = "SECRET_INJECTOR_PROBE_ADDR"
+	notifySignalVarName    = "SECRET_INJECTOR_NOTIFY_SIGNAL"   // e.g. SIGHUP
+	notifyPidFileVarName   = "SECRET_INJECTOR_NOTIFY_PID_FILE" // pid of the process to signal
+	notifyProcessVarName   = "SECRET_INJECTOR_NOTIFY_PROCESS"  // or its name, needs shareProcessNamespace
+	notifyURLVarName       = "SECRET_INJECTOR_NOTIFY_URL"      // POSTed to
+	notifyCommandVarName   = "SECRET_INJECTOR_NOTIFY_COMMAND"  // run with /bin/sh -c
+	defaultRefreshInterval = 5 * time.Minute
+	defaultProbeAddr       = ":8099"
+)
+
+var (
+	refreshInterval = flag.Duration("refresh-interval", 0, "sidecar: interval of secrets refresh, default 5m or env variable "+refreshIntervalVarName)
+	probeAddr       = flag.String("probe-addr", "", "sidecar: listen address of /healthz, /readyz and /status, default :8099 or env variable "+probeAddrVarName)
+)
+
+// state of the sidecar, exposed for probes. Never contains secret values
+type sidecarState struct {
+	mu          sync.RWMutex
+	Ready       bool      `json:"ready"`
+	Refreshes   int       `json:"refreshes"`
+	LastRefresh time.Time `json:"lastRefresh"`
+	NextRefresh time.Time `json:"nextRefresh"`
+	Files       int       `json:"files"`
+	Failed      []string  `json:"failed"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+type sidecar struct {
+	chain     *secretschain.SecretChainStruct
+	interval  time.Duration
+	files     map[string]string  // written file -> content
+	expired   *hcvault.ExpirySet // names of expired leases
+	notifiers []func() error
+	state     sidecarState
+}
+
+// Runs secret-injector as sidecar until SIGTERM
+func runSidecar() {
+	sc, err := newSidecar()
+	if err != nil {
+		log.Fatalf("%s %v", logPrefix, err)
+	}
+	go sc.serveProbes(utils.GetEnvVariableByName(probeAddrVarName))
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sc.run(stop)
+}
+
+// returns sidecar configured with flags and env variables
+func newSidecar() (*sidecar, error) {
+	chain, err := secretschain.NewSecretChain()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate secrets chain: %v", err)
+	}
+	sc := &sidecar{chain: chain, interval: *refreshInterval, files: make(map[string]string), expired: hcvault.NewExpirySet()}
+	if sc.interval == 0 {
+		sc.interval = defaultRefreshInterval
+		if v := utils.GetEnvVariableByName(refreshIntervalVarName); v != "" {
+			if sc.interval, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%s is not a valid duration for %s", v, refreshIntervalVarName)
+			}
+		}
+	}
+	if sc.notifiers, err = newNotifiers(); err != nil {
+		return nil, err
+	}
+	for _, s := range chain.Secrets {
+		if s.EnvVar != "" && s.FilePath == "" {
+			log.Warningf("%s secret '%s' of env variable %s is ignored, sidecar writes secret files only", logPrefix, s.Name, s.EnvVar)
+		}
+	}
+	return sc, nil
+}
+
+// refresh loop
+func (sc *sidecar) run(stop <-chan os.Signal) {
+	sc.refresh(nil, false)
+	if hc, ok := sc.chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct); ok && hc.Leases != nil {
+		hc.Leases.OnExpire(sc.expired.Add) // kept until the loop takes them, refresh may be busy
+		if err := hc.KeepTokenAlive(); err != nil {
+			log.Errorf("%s vault token will not be renewed: %v", logPrefix, err)
+		}
+	}
+
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sc.refresh(sc.due(), true)
+		case <-sc.expired.C():
+			expired := make(map[string]bool)
+			for _, name := range sc.expired.Take() {
+				expired[name] = true
+			}
+			if expired[hcvault.TokenLeaseName] { // before the secrets, they are fetched with the new token
+				sc.reauthenticate()
+				delete(expired, hcvault.TokenLeaseName)
+			}
+			if len(expired) == 0 {
+				continue
+			}
+			for name := range expired {
+				log.Infof("%s lease of %s expires, fetching it again", logPrefix, name)
+			}
+			sc.refresh(func(s *secretschain.SecretStruct) bool { return isLeased(s) && expired[leaseName(s)] }, true)
+		case sig := <-stop:
+			log.Infof("%s received %s, shutting down", logPrefix, sig)
+			if err := sc.chain.Close(); err != nil { // revokes leases
+				log.Errorf("%s %v", logPrefix, err)
+			}
+			return
+		}
+	}
+}
+
+// returns match of secrets refreshed on the interval: all but dynamic secrets and certificates whose lease keeps them
+// valid. Leased secrets which failed or have no lease, e.g. because the first fetch failed, are retried
+func (sc *sidecar) due() func(s *secretschain.SecretStruct) bool {
+	leased := make(map[string]bool)
+	if hc, ok := sc.chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct); ok && hc.Leases != nil {
+		for _, l := range hc.Leases.Leases() {
+			leased[l.Name] = true
+		}
+	}
+	return func(s *secretschain.SecretStruct) bool {
+		return !isLeased(s) || s.Err != nil || !leased[leaseName(s)]
+	}
+}
+
+// returns name of the lease of the secret, see LeaseManager.Track
+func leaseName(s *secretschain.SecretStruct) string {
+	return strings.TrimPrefix(s.VaultPath+s.Name, "/")
+}
+
+// re-authenticates to vault, when the token can't be renewed anymore
+func (sc *sidecar) reauthenticate() {
+	hc, ok := sc.chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct)
+	if !ok {
+		return
+	}
+	if err := hc.Reauthenticate(); err != nil {
+		log.Errorf("%s unable to re-authenticate to vault: %v", logPrefix, err)
+		return
+	}
+	if err := hc.KeepTokenAlive(); err != nil {
+		log.Errorf("%s vault token will not be renewed: %v", logPrefix, err)
+	}
+}
+
+// resolves secrets selected by match (all, if nil), rewrites changed files and notifies the application
+func (sc *sidecar) refresh(match func(s *secretschain.SecretStruct) bool, notify bool) {
+	err := sc.chain.ResolveWhere(match)
+	if err != nil {
+		log.Errorf("%s %v", logPrefix, err)
+	}
+
+	changed := 0
+	for idx := range sc.chain.Secrets {
+		s := &sc.chain.Secrets[idx]
+		if s.Err != nil || (match != nil && !match(s)) {
+			continue // failed secrets keep their last files
+		}
+		for name, f := range secretFiles(s) {
+			if old, ok := sc.files[name]; ok && old == f.content {
+				continue
+			}
+			mode := f.mode
+			if mode == 0 {
+				mode = defaultSecretFileMode
+			}
+			if err := secretsexport.WriteFile(name, []byte(f.content), mode); err != nil {
+				log.Errorf("%s unable to write secret file %s: %v", logPrefix, name, err)
+				continue
+			}
+			log.Infof("%s secret file %s updated", logPrefix, name)
+			sc.files[name] = f.content
+			changed++
+		}
+	}
+
+	failed := []string{}
+	for _, s := range sc.chain.Failed() {
+		failed = append(failed, s.Name+"@"+s.Origin)
+	}
+	sc.state.mu.Lock()
+	sc.state.Refreshes++
+	sc.state.LastRefresh = time.Now()
+	sc.state.NextRefresh = sc.state.LastRefresh.Add(sc.interval)
+	sc.state.Files = len(sc.files)
+	sc.state.Failed = failed
+	sc.state.Ready = len(failed) == 0 || sc.state.Ready
+	sc.state.LastError = ""
+	if err != nil {
+		sc.state.LastError = err.Error()
+	}
+	sc.state.mu.Unlock()
+
+	if changed > 0 && notify {
+		for _, n := range sc.notifiers {
+			if err := n(); err != nil {
+				log.Errorf("%s unable to notify application: %v", logPrefix, err)
+			}
+		}
+	}
+}
+
+// serves liveness (/healthz), readiness (/readyz) and state (/status) probes
+func (sc *sidecar) serveProbes(addr string) {
+	if *probeAddr != "" {
+		addr = *probeAddr
+	}
+	if addr == "" {
+		addr = defaultProbeAddr
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		sc.state.mu.RLock()
+		stale := !sc.state.LastRefresh.IsZero() && time.Since(sc.state.LastRefresh) > 3*sc.interval
+		sc.state.mu.RUnlock()
+		if stale {
+			http.Error(w, "refresh loop is stuck", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		sc.state.mu.RLock()
+		ready := sc.state.Ready
+		sc.state.mu.RUnlock()
+		if !ready {
+			http.Error(w, "secrets are not resolved yet", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		sc.state.mu.RLock()
+		defer sc.state.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&sc.state)
+	})
+	log.Infof("%s serving probes on %s", logPrefix, addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("%s probes server failed: %v", logPrefix, err)
+	}
+}
+
+// reports whether the secret is dynamic vault secret or certificate, i.e. it is fetched again when its lease expires
+// (at 2/3 of the certificate TTL) instead of on every refresh
+func isLeased(s *secretschain.SecretStruct) bool {
+	_, dynamic := s.Options[secinject.OptionDynamic]
+	_, pki := s.Options[secinject.OptionPKI]
+	return (dynamic || pki) && s.Origin == secretschain.HcVaultVarName
+}
+
+// returns notifiers configured with env variables
+func newNotifiers() ([]func() error, error) {
+	notifiers := []func() error{}
+	if name := utils.GetEnvVariableByName(notifySignalVarName); name != "" {
+		sig, err := parseSignal(name)
+		if err != nil {
+			return nil, err
+		}
+		pidFile, process := utils.GetEnvVariableByName(notifyPidFileVarName), utils.GetEnvVariableByName(notifyProcessVarName)
+		if pidFile == "" && process == "" {
+			return nil, fmt.Errorf("%s needs %s or %s", notifySignalVarName, notifyPidFileVarName, notifyProcessVarName)
+		}
+		notifiers = append(notifiers, func() error {
+			pids, err := findPids(pidFile, process)
+			if err != nil {
+				return err
+			}
+			for _, pid := range pids {
+				log.Infof("%s sending %s to process %d", logPrefix, sig, pid)
+				if err := syscall.Kill(pid, sig); err != nil {
+					return fmt.Errorf("unable to signal process %d: %v", pid, err)
+				}
+			}
+			return nil
+		})
+	}
+	if url := utils.GetEnvVariableByName(notifyURLVarName); url != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		notifiers = append(notifiers, func() error {
+			log.Infof("%s notifying %s", logPrefix, url)
+			resp, err := client.Post(url, "application/json", strings.NewReader(`{"event":"secrets-updated"}`))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("%s responded %s", url, resp.Status)
+			}
+			return nil
+		})
+	}
+	if command := utils.GetEnvVariableByName(notifyCommandVarName); command != "" {
+		notifiers = append(notifiers, func() error {
+			log.Infof("%s running %s", logPrefix, command)
+			out, err := exec.Command("/bin/sh", "-c", command).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s failed: %v: %s", command, err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		})
+	}
+	return notifiers, nil
+}
+
+// parses signal name, e.g. SIGHUP or HUP
+func parseSignal(name string) (syscall.Signal, error) {
+	signals := map[string]syscall.Signal{
+		"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT, "TERM": syscall.SIGTERM,
+		"USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2,
+	}
+	if sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s in %s", name, notifySignalVarName)
+}
+
+// returns pid from pid file, or pids of processes named process (from /proc, needs shared process namespace)
+func findPids(pidFile, process string) ([]int, error) {
+	if pidFile != "" {
+		b, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pid file: %v", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid file %s: %v", pidFile, err)
+		}
+		return []int{pid}, nil
+	}
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if comm, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil && strings.TrimSpace(string(comm)) == process {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process %s found, does the pod share its process namespace?", process)
+	}
+	return pids, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	hcvault "hc_vault_k8s"
+	"secretschain"
+	secinject "secretsinjector"
+)
+
+// stubProvider serves secrets from the map, by name
+type stubProvider map[string]string
+
+func (p stubProvider) Name() string { return "sidecarstub" }
+func (p stubProvider) Init() error  { return nil }
+func (p stubProvider) Close() error { return nil }
+func (p stubProvider) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		_ = s.SetSecret(p[s.Name])
+	}
+	return nil
+}
+
+func TestParseSignal(t *testing.T) {
+	t.Log("Testing signal names")
+	cases := map[string]syscall.Signal{"SIGHUP": syscall.SIGHUP, "hup": syscall.SIGHUP, "USR1": syscall.SIGUSR1, "sigterm": syscall.SIGTERM}
+	for name, expected := range cases {
+		if sig, err := parseSignal(name); err != nil || sig != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", name, expected, sig, err)
+		}
+	}
+	if _, err := parseSignal("KILL"); err == nil {
+		t.Errorf("unknown signal should fail")
+	}
+}
+
+func TestFindPidsFromPidFile(t *testing.T) {
+	t.Log("Testing pid of the application from pid file")
+	f, err := ioutil.TempFile("", "app.pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("4242\n")
+	f.Close()
+
+	if pids, err := findPids(f.Name(), "ignored"); err != nil || len(pids) != 1 || pids[0] != 4242 {
+		t.Errorf("expected pid 4242, got %v (%v)", pids, err)
+	}
+	ioutil.WriteFile(f.Name(), []byte("app"), 0644)
+	if _, err := findPids(f.Name(), ""); err == nil {
+		t.Errorf("invalid pid file should fail")
+	}
+	if _, err := findPids("/nonexistent/app.pid", ""); err == nil {
+		t.Errorf("missing pid file should fail")
+	}
+}
+
+func TestRefreshNotifiesOnChange(t *testing.T) {
+	t.Log("Testing application is notified only when secret files change")
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vault := stubProvider{"token": "t1"}
+	secretschain.RegisterProvider(vault.Name(), func() secretschain.Provider { return vault })
+
+	notified := 0
+	sc := &sidecar{
+		chain:     &secretschain.SecretChainStruct{Secrets: []secretschain.SecretStruct{{Name: "token", Origin: vault.Name(), FilePath: dir + "/", File: "token"}}},
+		interval:  time.Minute,
+		files:     make(map[string]string),
+		notifiers: []func() error{func() error { notified++; return nil }},
+	}
+	sc.refresh(nil, false)
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "token")); string(b) != "t1" || notified != 0 {
+		t.Errorf("expected file written without notification, got %q, %d notifications", b, notified)
+	}
+	sc.refresh(nil, true)
+	if notified != 0 {
+		t.Errorf("unchanged file should not notify")
+	}
+	vault["token"] = "t2"
+	sc.refresh(nil, true)
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "token")); string(b) != "t2" || notified != 1 {
+		t.Errorf("expected rotated file and notification, got %q, %d notifications", b, notified)
+	}
+	if sc.state.Refreshes != 3 || sc.state.Files != 1 || !sc.state.Ready {
+		t.Errorf("unexpected state: %d refreshes, %d files, ready %t", sc.state.Refreshes, sc.state.Files, sc.state.Ready)
+	}
+}
+
+func TestURLNotifier(t *testing.T) {
+	t.Log("Testing application is notified with HTTP POST")
+	status := http.StatusOK
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = r.Method + " " + string(b)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	os.Setenv(notifyURLVarName, server.URL+"/reload")
+	defer os.Unsetenv(notifyURLVarName)
+
+	notifiers, err := newNotifiers()
+	if err != nil || len(notifiers) != 1 {
+		t.Fatalf("expected URL notifier, got %d (%v)", len(notifiers), err)
+	}
+	if err := notifiers[0](); err != nil || body != `POST {"event":"secrets-updated"}` {
+		t.Errorf("unexpected request %q (%v)", body, err)
+	}
+	status = http.StatusInternalServerError
+	if err := notifiers[0](); err == nil {
+		t.Errorf("failed notification should be reported")
+	}
+}
+
+func TestIsLeased(t *testing.T) {
+	t.Log("Testing dynamic secrets and certificates are not refreshed on every tick")
+	cases := []struct {
+		secret secretschain.SecretStruct
+		leased bool
+	}{
+		{secretschain.SecretStruct{Origin: secretschain.HcVaultVarName, Options: map[string]string{secinject.OptionDynamic: ""}}, true},
+		{secretschain.SecretStruct{Origin: secretschain.HcVaultVarName, Options: map[string]string{secinject.OptionPKI: ""}}, true},
+		{secretschain.SecretStruct{Origin: secretschain.HcVaultVarName}, false},
+		{secretschain.SecretStruct{Origin: secretschain.AzureVaultVarName, Options: map[string]string{secinject.OptionPKI: ""}}, false},
+	}
+	for _, c := range cases {
+		if isLeased(&c.secret) != c.leased {
+			t.Errorf("%s %v: expected leased %t", c.secret.Origin, c.secret.Options, c.leased)
+		}
+	}
+}
+
+func TestDueRetriesLeasedSecrets(t *testing.T) {
+	t.Log("Testing leased secrets are refreshed on the interval until they have a lease")
+	leases := hcvault.NewLeaseManager()
+	defer leases.Close()
+	leases.TrackExpiry("pki/issue/web", time.Hour)
+	chain := &secretschain.SecretChainStruct{}
+	chain.UseProvider(&secinject.HCVaultClientStruct{Leases: leases})
+	sc := &sidecar{chain: chain}
+
+	dynamic := map[string]string{secinject.OptionDynamic: ""}
+	pki := map[string]string{secinject.OptionPKI: ""}
+	cases := []struct {
+		secret secretschain.SecretStruct
+		due    bool
+	}{
+		{secretschain.SecretStruct{Name: "web", VaultPath: "pki/issue/", Origin: secretschain.HcVaultVarName, Options: pki}, false},
+		{secretschain.SecretStruct{Name: "web", VaultPath: "pki/issue/", Origin: secretschain.HcVaultVarName, Options: pki, Err: os.ErrNotExist}, true},
+		{secretschain.SecretStruct{Name: "app", VaultPath: "database/creds/", Origin: secretschain.HcVaultVarName, Options: dynamic}, true},
+		{secretschain.SecretStruct{Name: "db", VaultPath: "secret/", Origin: secretschain.HcVaultVarName}, true},
+	}
+	due := sc.due()
+	for _, c := range cases {
+		if due(&c.secret) != c.due {
+			t.Errorf("%s%s (%v): expected due %t", c.secret.VaultPath, c.secret.Name, c.secret.Err, c.due)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Package k8s provides authentication with Vault on Kubernetes
+//
+// Besides the Kubernetes Auth Method, workloads on VMs and in CI authenticate with AppRole, JWT/OIDC,
+// Azure MSI, TLS certificate or a plain token. The method is selected with VAULT_AUTH_METHOD.
+//
+
+package hc_vault_k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"utils"
+)
+
+// Auth methods
+const (
+	AuthMethodKubernetes = "kubernetes"
+	AuthMethodAppRole    = "approle"
+	AuthMethodJWT        = "jwt"
+	AuthMethodAzure      = "azure"
+	AuthMethodCert       = "cert"
+	AuthMethodToken      = "token"
+)
+
+// Authenticator logs in to Vault with one auth method and returns client token
+type Authenticator interface {
+	// Method returns name of the auth method, which is also its default mount path
+	Method() string
+	// Login returns client token
+	Login(v *HCVault) (string, error)
+}
+
+// NewAuthenticator returns Authenticator of the auth method, configured from the environment
+func NewAuthenticator(method string) (Authenticator, error) {
+	switch strings.ToLower(method) {
+	case "", AuthMethodKubernetes:
+		return &kubernetesAuth{}, nil
+	case AuthMethodAppRole:
+		a := &appRoleAuth{RoleID: os.Getenv("VAULT_APPROLE_ROLE_ID"), SecretIDPath: os.Getenv("VAULT_APPROLE_SECRET_ID_PATH")}
+		if a.RoleID == "" {
+			return nil, fmt.Errorf("missing VAULT_APPROLE_ROLE_ID")
+		}
+		return a, nil
+	case AuthMethodJWT, "oidc":
+		a := &jwtAuth{JWTPath: os.Getenv("VAULT_JWT_PATH")}
+		if a.JWTPath == "" && os.Getenv("VAULT_JWT") == "" {
+			return nil, fmt.Errorf("missing VAULT_JWT_PATH or VAULT_JWT")
+		}
+		return a, nil
+	case AuthMethodAzure:
+		a := &azureAuth{Resource: os.Getenv("VAULT_AZURE_RESOURCE"), MetadataEndpoint: azureMetadataEndpoint}
+		if a.Resource == "" {
+			a.Resource = "https://management.azure.com/"
+		}
+		return a, nil
+	case AuthMethodCert:
+		return &certAuth{}, nil
+	case AuthMethodToken:
+		return &tokenAuth{}, nil
+	}
+	return nil, fmt.Errorf("unknown VAULT_AUTH_METHOD %s, expected one of kubernetes, approle, jwt, azure, cert, token", method)
+}
+
+// login writes data to <mount>/login and returns client token
+func (v *HCVault) login(data map[string]interface{}) (string, error) {
+	log.Debugf("using Address to login: %s", v.client.Address())
+	c := vaultLogical(v.client)
+	s, err := c.Write(path.Join(utils.FixAuthMountPath(v.AuthMountPath), "login"), data)
+	if err != nil {
+		return "", errors.Wrapf(err, "login with auth method %s failed", v.Authenticator.Method())
+	}
+	if s == nil || s.Auth == nil {
+		return "", fmt.Errorf("login with auth method %s returned no token", v.Authenticator.Method())
+	}
+	if len(s.Warnings) > 0 {
+		return "", fmt.Errorf("login failed with: %s", strings.Join(s.Warnings, " - "))
+	}
+	log.Debugf("Successful login with auth method %s", v.Authenticator.Method())
+	return s.Auth.ClientToken, nil
+}
+
+// reads trimmed content of file p
+func readTrimmed(p, what string) (string, error) {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", what)
+	}
+	return string(bytes.TrimSpace(content)), nil
+}
+
+// Kubernetes auth method: service-account JWT and VAULT_ROLE
+type kubernetesAuth struct{}
+
+func (a *kubernetesAuth) Method() string { return AuthMethodKubernetes }
+
+func (a *kubernetesAuth) Login(v *HCVault) (string, error) {
+	jwt, err := readTrimmed(v.ServiceAccountTokenPath, "jwt token")
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("using Role to login: %s", v.Role)
+	token, err := v.login(map[string]interface{}{"role": v.Role, "jwt": jwt})
+	if err != nil {
+		return "", errors.Wrapf(err, "login failed with role from environment variable VAULT_ROLE: %q", v.Role)
+	}
+	return token, nil
+}
+
+// AppRole auth method: VAULT_APPROLE_ROLE_ID and secret id from file VAULT_APPROLE_SECRET_ID_PATH
+// (or VAULT_APPROLE_SECRET_ID), secret id is optional for roles which don't require it
+type appRoleAuth struct {
+	RoleID       string
+	SecretIDPath string
+}
+
+func (a *appRoleAuth) Method() string { return AuthMethodAppRole }
+
+func (a *appRoleAuth) Login(v *HCVault) (string, error) {
+	data := map[string]interface{}{"role_id": a.RoleID}
+	secretID := os.Getenv("VAULT_APPROLE_SECRET_ID")
+	if a.SecretIDPath != "" {
+		var err error
+		if secretID, err = readTrimmed(a.SecretIDPath, "secret id"); err != nil {
+			return "", err
+		}
+	}
+	if secretID != "" {
+		data["secret_id"] = secretID
+	}
+	return v.login(data)
+}
+
+// JWT/OIDC auth method: JWT from file VAULT_JWT_PATH (e.g. CI job token) or VAULT_JWT, and VAULT_ROLE
+type jwtAuth struct {
+	JWTPath string
+}
+
+func (a *jwtAuth) Method() string { return AuthMethodJWT }
+
+func (a *jwtAuth) Login(v *HCVault) (string, error) {
+	jwt := os.Getenv("VAULT_JWT")
+	if a.JWTPath != "" {
+		var err error
+		if jwt, err = readTrimmed(a.JWTPath, "jwt"); err != nil {
+			return "", err
+		}
+	}
+	return v.login(map[string]interface{}{"role": v.Role, "jwt": jwt})
+}
+
+// Azure auth method: MSI access token and VM details from Azure Instance Metadata Service, and VAULT_ROLE
+type azureAuth struct {
+	Resource         string // audience of the MSI token, as configured in Vault
+	MetadataEndpoint string
+}
+
+const azureMetadataEndpoint = "http://169.254.169.254/metadata"
+
+func (a *azureAuth) Method() string { return AuthMethodAzure }
+
+func (a *azureAuth) Login(v *HCVault) (string, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {a.Resource}}
+	if err := a.metadata("/identity/oauth2/token?"+query.Encode(), &token); err != nil {
+		return "", errors.Wrap(err, "failed to get MSI token")
+	}
+	var instance struct {
+		Compute struct {
+			Name              string `json:"name"`
+			ResourceGroupName string `json:"resourceGroupName"`
+			SubscriptionID    string `json:"subscriptionId"`
+			VMScaleSetName    string `json:"vmScaleSetName"`
+		} `json:"compute"`
+	}
+	if err := a.metadata("/instance?api-version=2017-08-01", &instance); err != nil {
+		return "", errors.Wrap(err, "failed to get instance metadata")
+	}
+	data := map[string]interface{}{
+		"role":                v.Role,
+		"jwt":                 token.AccessToken,
+		"subscription_id":     instance.Compute.SubscriptionID,
+		"resource_group_name": instance.Compute.ResourceGroupName,
+	}
+	if instance.Compute.VMScaleSetName != "" {
+		data["vmss_name"] = instance.Compute.VMScaleSetName
+	} else {
+		data["vm_name"] = instance.Compute.Name
+	}
+	return v.login(data)
+}
+
+// queries Azure Instance Metadata Service
+func (a *azureAuth) metadata(query string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, a.MetadataEndpoint+query, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata service responded %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// TLS certificate auth method: client certificate VAULT_CLIENT_CERT/VAULT_CLIENT_KEY, VAULT_ROLE names the
+// certificate role (optional)
+type certAuth struct{}
+
+func (a *certAuth) Method() string { return AuthMethodCert }
+
+func (a *certAuth) Login(v *HCVault) (string, error) {
+	data := map[string]interface{}{}
+	if v.Role != "" {
+		data["name"] = v.Role
+	}
+	return v.login(data)
+}
+
+// plain token from VAULT_TOKEN or, if not set, from file VAULT_TOKEN_PATH
+type tokenAuth struct{}
+
+func (a *tokenAuth) Method() string { return AuthMethodToken }
+
+func (a *tokenAuth) Login(v *HCVault) (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	token, err := v.LoadToken()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(token), nil
+}
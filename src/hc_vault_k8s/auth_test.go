@@ -0,0 +1,141 @@
+package hc_vault_k8s
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// fake logical backend, records login requests
+type fakeLogical struct {
+	path string
+	data map[string]interface{}
+}
+
+func (f *fakeLogical) Write(path string, data map[string]interface{}) (*api.Secret, error) {
+	f.path, f.data = path, data
+	return &api.Secret{Auth: &api.SecretAuth{ClientToken: "s.login"}}, nil
+}
+
+func setenv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestAuthMethods(t *testing.T) {
+	t.Log("Testing auth methods selected with VAULT_AUTH_METHOD")
+	dir, err := ioutil.TempDir("", "vault-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretID := filepath.Join(dir, "secret-id")
+	tokenPath := filepath.Join(dir, "token")
+	_ = ioutil.WriteFile(secretID, []byte("sid\n"), 0600)
+
+	fake := &fakeLogical{}
+	orig := vaultLogical
+	vaultLogical = func(c *api.Client) vaultLogicalWriter { return fake }
+	defer func() { vaultLogical = orig }()
+
+	defer setenv(map[string]string{
+		"VAULT_TOKEN_PATH":             tokenPath,
+		"VAULT_AUTH_METHOD":            AuthMethodAppRole,
+		"VAULT_APPROLE_ROLE_ID":        "rid",
+		"VAULT_APPROLE_SECRET_ID_PATH": secretID,
+	})()
+	v, err := NewFromEnvironment()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := v.Authenticate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Errorf("token should be stored only with VAULT_STORE_TOKEN, got %v", err)
+	}
+
+	os.Setenv("VAULT_STORE_TOKEN", "true")
+	defer os.Unsetenv("VAULT_STORE_TOKEN")
+	if v, err = NewFromEnvironment(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := v.Authenticate()
+	if err != nil || token != "s.login" {
+		t.Fatalf("unexpected login result: %q %v", token, err)
+	}
+	if fake.path != "auth/approle/login" || fake.data["role_id"] != "rid" || fake.data["secret_id"] != "sid" {
+		t.Errorf("unexpected login request: %s %v", fake.path, fake.data)
+	}
+	if stored, _ := v.LoadToken(); stored != "s.login" {
+		t.Errorf("token of the login should be stored, got %q", stored)
+	}
+	if fi, err := os.Stat(tokenPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("stored token should be readable by the owner only: %v %v", fi.Mode(), err)
+	}
+
+	os.Setenv("VAULT_AUTH_METHOD", AuthMethodToken)
+	os.Unsetenv("VAULT_TOKEN")
+	if v, err = NewFromEnvironment(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token, err = v.Authenticate(); err != nil || token != "s.login" {
+		t.Errorf("expected stored token from file, got %q %v", token, err)
+	}
+
+	os.Setenv("VAULT_AUTH_METHOD", "ldap")
+	if _, err = NewFromEnvironment(); err == nil {
+		t.Errorf("unknown auth method should fail")
+	}
+}
+
+func TestAzureAuth(t *testing.T) {
+	t.Log("Testing Azure auth method against local metadata service")
+	resource := "https://vault.example.com/?tenant=a&b"
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			t.Errorf("metadata header is missing")
+		}
+		switch r.URL.Path {
+		case "/identity/oauth2/token":
+			if got := r.URL.Query().Get("resource"); got != resource {
+				t.Errorf("resource is not escaped: %q", got)
+			}
+			_, _ = w.Write([]byte(`{"access_token":"msi-jwt"}`))
+		case "/instance":
+			_, _ = w.Write([]byte(`{"compute":{"name":"vm1","resourceGroupName":"rg","subscriptionId":"sub"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer imds.Close()
+	fake := &fakeLogical{}
+	orig := vaultLogical
+	vaultLogical = func(c *api.Client) vaultLogicalWriter { return fake }
+	defer func() { vaultLogical = orig }()
+
+	client, err := api.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &HCVault{Role: "app", AuthMountPath: "azure", client: client,
+		Authenticator: &azureAuth{Resource: resource, MetadataEndpoint: imds.URL}}
+	token, err := v.Authenticator.Login(v)
+	if err != nil || token != "s.login" {
+		t.Fatalf("unexpected login result: %q %v", token, err)
+	}
+	if fake.path != "auth/azure/login" || fake.data["jwt"] != "msi-jwt" || fake.data["vm_name"] != "vm1" || fake.data["resource_group_name"] != "rg" {
+		t.Errorf("unexpected login request: %s %v", fake.path, fake.data)
+	}
+}
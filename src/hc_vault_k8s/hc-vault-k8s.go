@@ -1,18 +1,18 @@
 // Package k8s provides authentication with Vault on Kubernetes
 //
-// Authentication is done with the Kubernetes Auth Method by Vault.
+// Authentication is done with the Kubernetes Auth Method by Vault, or another method selected with
+// VAULT_AUTH_METHOD (see auth.go).
 //
 
 package hc_vault_k8s
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/api"
@@ -40,12 +40,18 @@ var vaultLogical = func(c *api.Client) vaultLogicalWriter {
 type HCVault struct {
 	Role                    string
 	TokenPath               string
+	PersistToken            bool // store token of the login in TokenPath, VAULT_STORE_TOKEN
 	ReAuth                  bool
 	TTL                     int
 	AuthMountPath           string
 	ServiceAccountTokenPath string
 	AllowFail               bool
+	Authenticator           Authenticator
+	Namespace               string // default Vault Enterprise namespace of secrets, VAULT_NAMESPACE
+	AuthNamespace           string // namespace to login in, VAULT_AUTH_NAMESPACE, defaults to Namespace
 	client                  *api.Client
+	nsMu                    sync.Mutex
+	nsClients               map[string]*api.Client // namespace -> client
 }
 
 // Client returns a Vault *api.Client
@@ -53,38 +59,19 @@ func (v *HCVault) Client() *api.Client {
 	return v.client
 }
 
-// Authenticate with vault
+// Authenticate with vault, using the auth method from VAULT_AUTH_METHOD. Token of the login is stored
+// in VAULT_TOKEN_PATH only if VAULT_STORE_TOKEN is set, see GetToken
 func (v *HCVault) Authenticate() (string, error) {
-	var empty string
-	// read jwt of serviceaccount
-	content, err := ioutil.ReadFile(v.ServiceAccountTokenPath)
+	token, err := v.Authenticator.Login(v)
 	if err != nil {
-		return empty, errors.Wrap(err, "failed to read jwt token")
+		return "", err
 	}
-	jwt := string(bytes.TrimSpace(content))
-	log.Debugf("using jwt to login: %s", jwt)
-	log.Debugf("using Role to login: %s", v.Role)
-	log.Debugf("using Address to login: %s", v.client.Address())
-
-	// authenticate
-	data := make(map[string]interface{})
-	data["role"] = v.Role
-	data["jwt"] = jwt
-
-	c := vaultLogical(v.client)
-	s, err := c.Write( path.Join( utils.FixAuthMountPath(v.AuthMountPath), "login" ), data )
-	if err != nil {
-		return empty, errors.Wrapf(err, "login failed with role from environment variable VAULT_ROLE: %q", v.Role)
-	}else{
-		log.Debugf("Successful login with role: %s", v.Role)
-	}
-
-	if len(s.Warnings) > 0 {
-		return empty, fmt.Errorf("login failed with: %s", strings.Join(s.Warnings, " - "))
-	}else{
-		log.Debugf("No warnings.")
+	if v.PersistToken && v.Authenticator.Method() != AuthMethodToken { // token method reads the token, nothing to store
+		if err := v.StoreToken(token); err != nil {
+			log.Warningf("token is not stored: %v", err)
+		}
 	}
-	return s.Auth.ClientToken, nil
+	return token, nil
 }
 
 // NewFromEnvironment returns a initialized Vault type for authentication
@@ -95,6 +82,13 @@ func NewFromEnvironment() (*HCVault, error) {
 	if v.TokenPath == "" {
 		return nil, fmt.Errorf("missing VAULT_TOKEN_PATH")
 	}
+	if s := os.Getenv("VAULT_STORE_TOKEN"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "1, t, T, TRUE, true, True, 0, f, F, FALSE, false, False are valid values for VAULT_STORE_TOKEN")
+		}
+		v.PersistToken = b
+	}
 	if s := os.Getenv("VAULT_REAUTH"); s != "" {
 		b, err := strconv.ParseBool(s)
 		if err != nil {
@@ -109,7 +103,11 @@ func NewFromEnvironment() (*HCVault, error) {
 		}
 		v.TTL = int(d.Seconds())
 	}
-	v.AuthMountPath = utils.FixAuthMountPath(AuthMountPath) // use default
+	var err error
+	if v.Authenticator, err = NewAuthenticator(os.Getenv("VAULT_AUTH_METHOD")); err != nil {
+		return nil, err
+	}
+	v.AuthMountPath = utils.FixAuthMountPath(v.Authenticator.Method()) // use default, e.g. auth/kubernetes
 	if p := os.Getenv("VAULT_AUTH_MOUNT_PATH"); p != "" {
 		v.AuthMountPath = utils.FixAuthMountPath(p) // if set, use value from environment
 	}
@@ -124,23 +122,65 @@ func NewFromEnvironment() (*HCVault, error) {
 		}
 		v.AllowFail = b
 	}
+	v.Namespace = strings.Trim(os.Getenv("VAULT_NAMESPACE"), "/")
+	v.AuthNamespace = strings.Trim(os.Getenv("VAULT_AUTH_NAMESPACE"), "/")
+	if v.AuthNamespace == "" {
+		v.AuthNamespace = v.Namespace
+	}
 	// create vault client
 	vaultConfig := api.DefaultConfig()
 	if err := vaultConfig.ReadEnvironment(); err != nil {
 		return nil, errors.Wrap(err, "failed to read environment for vault")
 	}
-	var err error
+	if err := ConfigureTLS(vaultConfig); err != nil { // verification on, unless explicitly turned off
+		return nil, err
+	}
 	v.client, err = api.NewClient(vaultConfig)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create vault client")
 	}
+	// login and token renewal happen in the auth namespace, secrets are read with NamespaceClient
+	if v.AuthNamespace != "" {
+		v.client.SetNamespace(v.AuthNamespace)
+	} else {
+		v.client.ClearNamespace()
+	}
 	return v, nil
 }
 
+// NamespaceClient returns client for requests in Vault Enterprise namespace ns, sharing token of the login.
+// Empty ns means the default namespace (VAULT_NAMESPACE), leading and trailing slashes are ignored
+func (v *HCVault) NamespaceClient(ns string) (*api.Client, error) {
+	ns = strings.Trim(ns, "/")
+	if ns == "" {
+		ns = v.Namespace
+	}
+	if ns == v.AuthNamespace {
+		return v.client, nil
+	}
+	v.nsMu.Lock()
+	defer v.nsMu.Unlock()
+	if c, ok := v.nsClients[ns]; ok {
+		c.SetToken(v.client.Token()) // token may have been renewed by re-authentication
+		return c, nil
+	}
+	c, err := v.client.Clone()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create client for namespace %s", ns)
+	}
+	c.SetToken(v.client.Token())
+	c.SetNamespace(ns)
+	if v.nsClients == nil {
+		v.nsClients = make(map[string]*api.Client)
+	}
+	v.nsClients[ns] = c
+	return c, nil
+}
+
 
 // StoreToken in VaultTokenPath
 func (v *HCVault) StoreToken(token string) error {
-	if err := ioutil.WriteFile(v.TokenPath, []byte(token), 0644); err != nil {
+	if err := ioutil.WriteFile(v.TokenPath, []byte(token), 0600); err != nil {
 		return errors.Wrap(err, "failed to store token")
 	}
 	return nil
@@ -0,0 +1,246 @@
+// Package k8s provides authentication with Vault on Kubernetes
+//
+// LeaseManager keeps leases of dynamic secrets (and the token they depend on) alive
+// with api.Renewer, and revokes them on shutdown.
+//
+
+package hc_vault_k8s
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenLeaseName is name of the token in LeaseManager callbacks
+const TokenLeaseName = "vault token"
+
+// Lease of a dynamic secret, or expiry of a secret without lease, e.g. certificate (empty LeaseID)
+type Lease struct {
+	Name      string // reference of the secret, for logging
+	LeaseID   string
+	Duration  int // seconds
+	Renewable bool
+	client    *api.Client // client of the namespace the lease belongs to
+	renewer   *api.Renewer
+	timer     *time.Timer // expiry of not renewable lease
+}
+
+// LeaseManager renews leases while the process runs and revokes them on Close
+type LeaseManager struct {
+	mu       sync.Mutex
+	onExpire func(name string)
+	leases   []*Lease
+	token    *api.Renewer
+	closing  bool
+	wg       sync.WaitGroup
+}
+
+// NewLeaseManager returns empty LeaseManager
+func NewLeaseManager() *LeaseManager {
+	return &LeaseManager{}
+}
+
+// OnExpire sets callback, which is called with name of the lease (or TokenLeaseName) which can't be renewed anymore,
+// i.e. the secret should be fetched again (or the token re-authenticated). Callback must not block
+func (m *LeaseManager) OnExpire(f func(name string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onExpire = f
+}
+
+// Track starts renewal of the lease of secret s, obtained with client c. Secrets without lease are ignored.
+// Not renewable leases are reported to the OnExpire callback at 2/3 of their duration
+func (m *LeaseManager) Track(c *api.Client, name string, s *api.Secret) error {
+	if s == nil || s.LeaseID == "" {
+		return nil
+	}
+	l := &Lease{Name: name, LeaseID: s.LeaseID, Duration: s.LeaseDuration, Renewable: s.Renewable, client: c}
+	if s.Renewable {
+		renewer, err := c.NewRenewer(&api.RenewerInput{Secret: s})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get renewer for lease of %s", name)
+		}
+		l.renewer = renewer
+		m.watch(name, renewer, func() { m.expire(l) })
+	} else {
+		log.Warningf("lease of %s is not renewable, it expires in %ds", name, s.LeaseDuration)
+		l.timer = time.AfterFunc(time.Duration(s.LeaseDuration)*time.Second*2/3, func() { m.expire(l) })
+	}
+	m.mu.Lock()
+	m.leases = append(m.leases, l)
+	m.mu.Unlock()
+	log.Infof("tracking lease %s of %s, ttl %ds", l.LeaseID, name, l.Duration)
+	return nil
+}
+
+// TrackExpiry reports secret without lease, e.g. issued certificate valid for ttl, to the OnExpire callback
+// at 2/3 of ttl, so it is issued again before it expires. Nothing is revoked on Close
+func (m *LeaseManager) TrackExpiry(name string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	l := &Lease{Name: name, Duration: int(ttl / time.Second)}
+	l.timer = time.AfterFunc(ttl*2/3, func() { m.expire(l) })
+	m.mu.Lock()
+	m.leases = append(m.leases, l)
+	m.mu.Unlock()
+	log.Infof("tracking expiry of %s, ttl %ds", name, l.Duration)
+}
+
+// RenewToken keeps token alive while leases are tracked, leases are revoked by Vault when their token expires
+func (m *LeaseManager) RenewToken(renewer *api.Renewer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != nil {
+		return
+	}
+	m.token = renewer
+	m.watch(TokenLeaseName, renewer, func() {
+		m.mu.Lock()
+		if m.token == renewer {
+			m.token = nil
+		}
+		closing, onExpire := m.closing, m.onExpire
+		m.mu.Unlock()
+		if !closing && onExpire != nil {
+			onExpire(TokenLeaseName)
+		}
+	})
+}
+
+// RenewsToken reports whether the token is renewed already
+func (m *LeaseManager) RenewsToken() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.token != nil
+}
+
+// Leases returns tracked leases
+func (m *LeaseManager) Leases() []*Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Lease{}, m.leases...)
+}
+
+// Close stops renewal and revokes all tracked leases
+func (m *LeaseManager) Close() error {
+	m.mu.Lock()
+	leases, token := m.leases, m.token
+	m.leases, m.token, m.closing = nil, nil, true
+	m.mu.Unlock()
+
+	var first error
+	for _, l := range leases {
+		if l.renewer != nil {
+			l.renewer.Stop()
+		}
+		if l.timer != nil {
+			l.timer.Stop()
+		}
+		if l.LeaseID == "" {
+			continue
+		}
+		if err := l.client.Sys().Revoke(l.LeaseID); err != nil {
+			log.Errorf("failed to revoke lease %s of %s: %v", l.LeaseID, l.Name, err)
+			if first == nil {
+				first = errors.Wrapf(err, "failed to revoke lease of %s", l.Name)
+			}
+			continue
+		}
+		log.Infof("revoked lease %s of %s", l.LeaseID, l.Name)
+	}
+	if token != nil {
+		token.Stop()
+	}
+	m.wg.Wait()
+	return first
+}
+
+// forgets lease l, which can't be renewed anymore, and reports it to OnExpire
+func (m *LeaseManager) expire(l *Lease) {
+	m.mu.Lock()
+	found := false
+	for idx := range m.leases {
+		if m.leases[idx] == l {
+			m.leases = append(m.leases[:idx], m.leases[idx+1:]...)
+			found = true
+			break
+		}
+	}
+	closing, onExpire := m.closing, m.onExpire
+	m.mu.Unlock()
+	if found && !closing && onExpire != nil {
+		log.Infof("lease %s of %s expires", l.LeaseID, l.Name)
+		onExpire(l.Name)
+	}
+}
+
+// runs renewer until it is stopped or the lease can't be renewed anymore, then calls done
+func (m *LeaseManager) watch(name string, renewer *api.Renewer, done func()) {
+	m.wg.Add(1)
+	go renewer.Renew()
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case err := <-renewer.DoneCh():
+				if err != nil {
+					log.Errorf("failed to renew lease of %s: %v", name, err)
+				} else {
+					log.Debugf("renewal of %s stopped", name)
+				}
+				done()
+				return
+			case r := <-renewer.RenewCh():
+				log.Debugf("renewed lease of %s at %s", name, r.RenewedAt)
+			}
+		}
+	}()
+}
+
+// ExpirySet collects names reported to OnExpire until they are taken. Names are never dropped while the consumer
+// is busy, the same name reported many times is taken once
+type ExpirySet struct {
+	mu    sync.Mutex
+	names map[string]bool
+	wake  chan struct{}
+}
+
+// NewExpirySet returns empty ExpirySet
+func NewExpirySet() *ExpirySet {
+	return &ExpirySet{names: make(map[string]bool), wake: make(chan struct{}, 1)}
+}
+
+// Add adds name and wakes the consumer. It never blocks, so it can be used as OnExpire callback
+func (e *ExpirySet) Add(name string) {
+	e.mu.Lock()
+	e.names[name] = true
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default: // consumer is woken already and takes the name with the others
+	}
+}
+
+// C returns channel which receives when names were added
+func (e *ExpirySet) C() <-chan struct{} {
+	return e.wake
+}
+
+// Take returns added names, sorted, and empties the set
+func (e *ExpirySet) Take() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.names))
+	for name := range e.names {
+		names = append(names, name)
+	}
+	e.names = make(map[string]bool)
+	sort.Strings(names)
+	return names
+}
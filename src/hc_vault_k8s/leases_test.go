@@ -0,0 +1,33 @@
+package hc_vault_k8s
+
+import (
+	"testing"
+)
+
+func TestExpirySet(t *testing.T) {
+	t.Log("Testing expiries are kept until taken, even when the consumer is busy")
+	e := NewExpirySet()
+	for i := 0; i < 100; i++ {
+		e.Add("database/creds/app")
+	}
+	e.Add(TokenLeaseName)
+	e.Add("pki/issue/web")
+
+	select {
+	case <-e.C():
+	default:
+		t.Fatalf("consumer should be woken")
+	}
+	names := e.Take()
+	if len(names) != 3 || names[0] != "database/creds/app" || names[1] != "pki/issue/web" || names[2] != TokenLeaseName {
+		t.Errorf("expected every name once, got %v", names)
+	}
+	if names := e.Take(); len(names) != 0 {
+		t.Errorf("taken names should be removed, got %v", names)
+	}
+	select {
+	case <-e.C():
+		t.Errorf("consumer should be woken once")
+	default:
+	}
+}
@@ -0,0 +1,170 @@
+// Package k8s provides authentication with Vault on Kubernetes
+//
+// TLS of Vault connections is verified by default. Besides VAULT_CACERT, VAULT_CAPATH, VAULT_CLIENT_CERT,
+// VAULT_CLIENT_KEY and VAULT_TLS_SERVER_NAME of the Vault client, CA bundle may come from a mounted ConfigMap
+// and server's public key may be pinned. Verification is turned off only with the explicit insecure switch.
+//
+
+package hc_vault_k8s
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants
+const (
+	CABundlePathVarName    = "VAULT_CA_BUNDLE_PATH"                     // PEM file or directory, e.g. mounted ConfigMap
+	SPKIPinsVarName        = "VAULT_TLS_SPKI_PINS"                      // comma separated base64 SHA-256 of SubjectPublicKeyInfo
+	InsecureSkipVerifyName = "SECRET_INJECTOR_INSECURE_SKIP_TLS_VERIFY" // explicit switch to turn verification off
+	skipVerifyVaultVarName = "VAULT_SKIP_VERIFY"
+)
+
+// InsecureSkipVerify turns off verification of Vault's certificate, set by -insecure-skip-tls-verify flag
+var InsecureSkipVerify bool
+
+// reports whether verification is explicitly turned off
+func insecureSkipVerify() bool {
+	if InsecureSkipVerify {
+		return true
+	}
+	b, _ := strconv.ParseBool(os.Getenv(InsecureSkipVerifyName))
+	return b
+}
+
+// ConfigureTLS applies TLS settings from the environment to Vault client config
+func ConfigureTLS(config *api.Config) error {
+	insecure := insecureSkipVerify()
+	if b, _ := strconv.ParseBool(os.Getenv(skipVerifyVaultVarName)); b && !insecure {
+		log.Warningf("%s is ignored, TLS certificate of Vault is verified. Set %s=true or -insecure-skip-tls-verify to turn verification off",
+			skipVerifyVaultVarName, InsecureSkipVerifyName)
+	}
+	if insecure {
+		log.Warning("!!! INSECURE: TLS certificate verification of Vault is OFF, secrets and tokens can be intercepted !!!")
+		log.Warning("!!! INSECURE: use it for local development only, never in production !!!")
+	}
+
+	t := &api.TLSConfig{
+		CACert:        os.Getenv(api.EnvVaultCACert),
+		CAPath:        os.Getenv(api.EnvVaultCAPath),
+		ClientCert:    os.Getenv(api.EnvVaultClientCert),
+		ClientKey:     os.Getenv(api.EnvVaultClientKey),
+		TLSServerName: os.Getenv(api.EnvVaultTLSServerName),
+		Insecure:      insecure,
+	}
+	if err := config.ConfigureTLS(t); err != nil {
+		return errors.Wrap(err, "failed to configure TLS for vault")
+	}
+	transport, ok := config.HttpClient.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return fmt.Errorf("unexpected transport of vault client")
+	}
+	tlsConfig := transport.TLSClientConfig
+	tlsConfig.InsecureSkipVerify = insecure // api.DefaultConfig has already applied VAULT_SKIP_VERIFY
+	if tlsConfig.MinVersion < tls.VersionTLS12 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+
+	if p := os.Getenv(CABundlePathVarName); p != "" {
+		pool, err := loadCABundle(p)
+		if err != nil {
+			return err
+		}
+		// bundle replaces system roots; pools can't be merged, so CAs of VAULT_CACERT/VAULT_CAPATH are loaded again
+		if err := appendCAs(pool, t.CACert, t.CAPath); err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if pins := os.Getenv(SPKIPinsVarName); pins != "" {
+		set := make(map[string]bool)
+		for _, pin := range strings.Split(pins, ",") {
+			if pin = strings.TrimSpace(pin); pin != "" {
+				set[strings.TrimPrefix(pin, "sha256/")] = true
+			}
+		}
+		tlsConfig.VerifyPeerCertificate = verifySPKIPins(set)
+	}
+	return nil
+}
+
+// returns VerifyPeerCertificate callback, which accepts the chain if any of its certificates matches one of the pins
+func verifySPKIPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+		return fmt.Errorf("public key of vault server matches none of the pins in %s", SPKIPinsVarName)
+	}
+}
+
+// loads CA certificates from PEM file p or from every file of directory p (hidden files of ConfigMap mounts are skipped)
+func loadCABundle(p string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := appendCAs(pool, "", p); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// appends CA certificates of file and of files in directory dir to the pool
+func appendCAs(pool *x509.CertPool, file, dir string) error {
+	files := []string{}
+	if file != "" {
+		files = append(files, file)
+	}
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return errors.Wrap(err, "failed to read CA bundle")
+		}
+		if !info.IsDir() {
+			files = append(files, dir)
+		} else {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return errors.Wrap(err, "failed to read CA bundle")
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), ".") {
+					continue // e.g. ..data of ConfigMap mounts
+				}
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err != nil || fi.IsDir() {
+			continue
+		}
+		pem, err := ioutil.ReadFile(f)
+		if err != nil {
+			return errors.Wrap(err, "failed to read CA bundle")
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificates found in %s", f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package hc_vault_k8s
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	t.Log("Testing TLS verification of vault connections")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "vault-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	_ = ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caPEM, 0644)
+	_ = os.Mkdir(filepath.Join(dir, "..2020_01_01"), 0755) // ConfigMap mounts have hidden dirs
+	sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	cases := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"verified by default", map[string]string{}, false},
+		{"VAULT_SKIP_VERIFY alone is ignored", map[string]string{skipVerifyVaultVarName: "true"}, false},
+		{"CA bundle from ConfigMap", map[string]string{CABundlePathVarName: dir}, true},
+		{"CA bundle with matching pin", map[string]string{CABundlePathVarName: dir, SPKIPinsVarName: "sha256/" + pin}, true},
+		{"CA bundle with other pin", map[string]string{CABundlePathVarName: dir, SPKIPinsVarName: "AAAA"}, false},
+		{"explicit insecure switch", map[string]string{InsecureSkipVerifyName: "true"}, true},
+	}
+	for _, c := range cases {
+		restore := setenv(c.env)
+		config := api.DefaultConfig()
+		err := ConfigureTLS(config)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = config.HttpClient.Get(server.URL); err == nil {
+				resp.Body.Close()
+			}
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expected ok=%v, got %v", c.name, c.ok, err)
+		}
+		restore()
+	}
+}
@@ -31,6 +31,7 @@ type VaultClient struct {
 // p = secret/ -> K/V engine mount path secret/
 // p = secret  -> error
 // p = /secret -> error
+// Secrets are read in the Vault Enterprise namespace of c, if any
 func NewVClient(c *api.Client, p string) (*VaultClient, error) {
 	if strings.HasPrefix(p, "/") {
 		return nil, fmt.Errorf("path %s must not start with '/'", p)
@@ -0,0 +1,97 @@
+// Module hosts expansion of secrets into env variables, i.e. one env variable per key of a secret
+//
+
+package secretschain
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	OptionExpand = "expand" // expand secret into one env variable per key, value of the option is the prefix
+)
+
+// expandJSON turns JSON object into key/value pairs. String values are used raw, the rest as JSON
+func expandJSON(value string) (map[string]string, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return nil, fmt.Errorf("value is not JSON object: %v", err)
+	}
+	values := make(map[string]string)
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			values[k] = s
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = string(raw)
+	}
+	return values, nil
+}
+
+// EnvName maps key of the secret to env variable name: prefix + key uppercased,
+// with every character which is not letter, digit or '_' (e.g. '-', '.', '/') turned into '_'
+func EnvName(prefix, key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, strings.Trim(key, "/"))
+	return prefix + name
+}
+
+// Environment returns env variables to be set for the secrets in the chain.
+// Expanded secrets produce one variable per key instead of their own. Expanded names which clash with env variables
+// set before the chain was created or with other secrets are not set and reported as errors.
+// Secrets which could not be retrieved are left out, see Failed
+func (self *SecretChainStruct) Environment() (map[string]string, []error) {
+	env := make(map[string]string)
+	errs := []error{}
+
+	// plain secrets first, they own their env variables
+	owned := make(map[string]string)
+	for idx := range self.Secrets {
+		s := &self.Secrets[idx]
+		if s.Err != nil {
+			continue
+		}
+		if _, expand := s.Options[OptionExpand]; s.EnvVar != "" && !expand {
+			env[s.EnvVar] = s.Secret
+			owned[s.EnvVar] = s.Name
+		}
+	}
+	for idx := range self.Secrets {
+		s := &self.Secrets[idx]
+		prefix, ok := s.Options[OptionExpand]
+		if !ok || s.Values == nil || s.Err != nil {
+			continue
+		}
+		keys := make([]string, 0, len(s.Values))
+		for k := range s.Values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // keep errors stable
+		for _, k := range keys {
+			name := EnvName(prefix, k)
+			if other, ok := owned[name]; ok {
+				errs = append(errs, fmt.Errorf("secret '%s': key '%s' clashes with env variable %s of secret '%s'", s.Name, k, name, other))
+				continue
+			}
+			if self.environ[name] { // snapshot, the process env already has the secrets once they were injected
+				errs = append(errs, fmt.Errorf("secret '%s': key '%s' clashes with existing env variable %s", s.Name, k, name))
+				continue
+			}
+			env[name] = s.Values[k]
+			owned[name] = s.Name
+		}
+	}
+	return env, errs
+}
@@ -0,0 +1,161 @@
+// Module hosts declarative secrets manifest, an alternative to the env-var convention
+//
+// Manifest is YAML or JSON document:
+//
+//   secrets:
+//   - name: mysql
+//     origin: hashicorpvault
+//     vaultPath: secret/appCodes/aeo0/sample-express-backend/dev/
+//     field: password
+//     env: MYDB2_CREDS
+//     file: /etc/secrets/mysql
+//     mode: "0400"
+//     options:
+//       key: value
+//
+
+package secretschain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ManifestEnvVarName = "SECRET_INJECTOR_MANIFEST" // env variable holding path to the manifest
+)
+
+// ManifestSecret describes single secret in the manifest
+type ManifestSecret struct {
+	Name      string            `json:"name"`
+	Origin    string            `json:"origin"`
+	VaultPath string            `json:"vaultPath,omitempty"`
+	Field     string            `json:"field,omitempty"` // gjson path of the field to select, same as "<name>#<field>"
+	EnvVar    string            `json:"env,omitempty"`
+	File      string            `json:"file,omitempty"` // full path of the secret file
+	Mode      string            `json:"mode,omitempty"` // octal permission mask, e.g. "0400"
+	Options   map[string]string `json:"options,omitempty"`
+}
+
+// Manifest lists the secrets to inject
+type Manifest struct {
+	Secrets []ManifestSecret `json:"secrets"`
+}
+
+// LoadManifest reads and validates manifest file p
+func LoadManifest(p string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest %s", p)
+	}
+	m := &Manifest{}
+	// strict, so misspelled fields are reported instead of silently ignored
+	if err := yaml.UnmarshalStrict(b, m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest %s", p)
+	}
+	return m, nil
+}
+
+// SecretStructs converts manifest into list of SecretStruct, failing on the first invalid entry
+func (m *Manifest) SecretStructs() ([]SecretStruct, error) {
+	secrets := []SecretStruct{}
+	for idx, ms := range m.Secrets {
+		s, err := ms.secretStruct()
+		if err != nil {
+			return nil, errors.Wrapf(err, "manifest entry #%d (%s)", idx, ms.Name)
+		}
+		secrets = append(secrets, *s)
+	}
+	return secrets, nil
+}
+
+func (ms *ManifestSecret) secretStruct() (*SecretStruct, error) {
+	if ms.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	origin := lookupOrigin(ms.Origin)
+	if origin == "" {
+		return nil, fmt.Errorf("unknown origin %q", ms.Origin)
+	}
+	if ms.EnvVar == "" && ms.File == "" {
+		return nil, fmt.Errorf("neither env nor file is set")
+	}
+
+	name, field := splitField(ms.Name)
+	if ms.Field != "" {
+		field = ms.Field
+	}
+	s := &SecretStruct{
+		Name:      name,
+		Field:     field,
+		Origin:    origin,
+		VaultPath: ms.VaultPath,
+		EnvVar:    ms.EnvVar,
+		Options:   ms.Options,
+	}
+	if s.VaultPath == "" {
+		s.Name, s.VaultPath = splitVaultPath(name, origin)
+	} else if !strings.HasSuffix(s.VaultPath, "/") {
+		s.VaultPath += "/"
+	}
+	if ms.File != "" {
+		dir, file := path.Split(ms.File)
+		if file == "" {
+			return nil, fmt.Errorf("file %q must not be a directory", ms.File)
+		}
+		s.FilePath = strings.TrimSuffix(dir, "/") + "/"
+		s.File = file
+	}
+	if ms.Mode != "" {
+		mode, err := strconv.ParseUint(ms.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid mode %q, expected octal permission mask like \"0400\"", ms.Mode)
+		}
+		s.Mode = os.FileMode(mode)
+	}
+	return s, nil
+}
+
+// loadManifest merges secrets from manifest p into the chain.
+// Manifest entry replaces env-derived secrets which target the same env variable or file
+func (self *SecretChainStruct) loadManifest(p string) error {
+	m, err := LoadManifest(p)
+	if err != nil {
+		return err
+	}
+	secrets, err := m.SecretStructs()
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		if n := self.removeTarget(&s); n > 0 {
+			log.Debugf("manifest secret %s replaces %d secret(s) defined by env", s.Name, n)
+		}
+		self.add(s)
+	}
+	log.Debugf("loaded %d secret(s) from manifest %s", len(secrets), p)
+	return nil
+}
+
+// removeTarget removes secrets with the same target (env var or file) as s from the chain
+func (self *SecretChainStruct) removeTarget(s *SecretStruct) int {
+	kept := self.Secrets[:0]
+	for _, c := range self.Secrets {
+		if (s.EnvVar != "" && strings.EqualFold(c.EnvVar, s.EnvVar)) ||
+			(s.File != "" && c.File == s.File && c.FilePath == s.FilePath) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	n := len(self.Secrets) - len(kept)
+	self.Secrets = kept
+	return n
+}
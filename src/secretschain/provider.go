@@ -0,0 +1,236 @@
+// Module hosts Provider interface and the registry of providers, one provider per origin
+//
+// Backends register themselves (usually from init()) with RegisterProvider, which makes
+// "<name>@<origin>" references and SECRET_STORE_SYSTEM_<n>=<origin> recognised by the parser,
+// and lets Resolve dispatch secrets of that origin to the provider.
+//
+
+package secretschain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider retrieves secrets of one origin
+type Provider interface {
+	// Name returns the origin served by the provider, e.g. "hashicorpvault"
+	Name() string
+	// Init initializes the provider and authenticates against the backend
+	Init() error
+	// Fetch retrieves the batch of secrets, populating them with SetSecret.
+	// Failures of single secrets are recorded with Fail; returned error fails the whole batch
+	Fetch(secrets []*SecretStruct) error
+	// Close releases resources held by the provider
+	Close() error
+}
+
+// ChainedProvider is a Provider which uses other providers of its chain, e.g. to share their login.
+// SetChain is called before Init
+type ChainedProvider interface {
+	Provider
+	SetChain(chain *SecretChainStruct)
+}
+
+// ProviderFactory creates new, not yet initialized, Provider
+type ProviderFactory func() Provider
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]ProviderFactory) // key = lower case origin
+	origins    = make(map[string]string)          // lower case origin -> canonical origin
+	redirects  = make(map[string]string)          // lower case origin -> origin of the provider serving it instead
+)
+
+// RegisterProvider makes provider available for the origin. Origins are case insensitive
+func RegisterProvider(origin string, factory ProviderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	key := strings.ToLower(origin)
+	if _, ok := registry[key]; ok {
+		panic(fmt.Sprintf("secretschain: provider for origin %s is already registered", origin))
+	}
+	registry[key] = factory
+	origins[key] = origin
+}
+
+// RedirectOrigin makes secrets of origin "from" served by the provider of origin "to",
+// e.g. to resolve vault references from a local file. References keep their origin
+func RedirectOrigin(from, to string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	log.Infof("secrets of origin %s are served by provider %s", from, to)
+	redirects[strings.ToLower(from)] = to
+}
+
+// servingOrigin returns origin of the provider which serves secrets of the origin
+func servingOrigin(origin string) string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if to, ok := redirects[strings.ToLower(origin)]; ok {
+		return to
+	}
+	return origin
+}
+
+// Origins returns sorted list of registered origins
+func Origins() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	list := make([]string, 0, len(origins))
+	for _, o := range origins {
+		list = append(list, o)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// lookupOrigin returns canonical name of the origin, or "" if origin is unknown
+func lookupOrigin(origin string) string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return origins[strings.ToLower(origin)]
+}
+
+// newProvider creates provider for the origin
+func newProvider(origin string) (Provider, error) {
+	registryMu.RLock()
+	factory, ok := registry[strings.ToLower(origin)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no provider registered for origin %s", origin)
+	}
+	return factory(), nil
+}
+
+// Fail records failure to retrieve the secret
+func (s *SecretStruct) Fail(err error) {
+	s.Err = err
+	log.Errorf("unable to retrieve secret '%s' from %s: %v", s.Name, s.Origin, err)
+}
+
+// Failed returns secrets which could not be retrieved
+func (self *SecretChainStruct) Failed() []*SecretStruct {
+	failed := []*SecretStruct{}
+	for idx := range self.Secrets {
+		if self.Secrets[idx].Err != nil {
+			failed = append(failed, &self.Secrets[idx])
+		}
+	}
+	return failed
+}
+
+// Resolve retrieves all secrets of the chain, dispatching them to the providers by origin.
+// Providers are initialized on first use and kept for subsequent calls, until Close.
+// Returned error summarizes failed secrets, the rest of the chain is resolved anyway
+func (self *SecretChainStruct) Resolve() error {
+	return self.ResolveWhere(nil)
+}
+
+// ResolveWhere retrieves secrets of the chain for which match returns true, e.g. to refresh some of them only.
+// Nil match selects all secrets
+func (self *SecretChainStruct) ResolveWhere(match func(s *SecretStruct) bool) error {
+	batches := make(map[string][]*SecretStruct)
+	order := []string{}
+	for idx := range self.Secrets {
+		s := &self.Secrets[idx]
+		if match != nil && !match(s) {
+			continue
+		}
+		s.Err = nil
+		if _, ok := batches[s.Origin]; !ok {
+			order = append(order, s.Origin)
+		}
+		batches[s.Origin] = append(batches[s.Origin], s)
+	}
+
+	for _, origin := range order {
+		p, err := self.provider(servingOrigin(origin))
+		if err == nil {
+			log.Debugf("resolving %d secret(s) of %s with provider %s", len(batches[origin]), origin, p.Name())
+			err = p.Fetch(batches[origin])
+		}
+		if err != nil {
+			for _, s := range batches[origin] {
+				s.Fail(err)
+			}
+		}
+	}
+
+	names := []string{}
+	for _, origin := range order {
+		for _, s := range batches[origin] {
+			if s.Err != nil {
+				names = append(names, s.Name+"@"+s.Origin)
+			}
+		}
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("unable to retrieve %d secret(s): %s", len(names), strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// provider returns initialized provider for the origin
+func (self *SecretChainStruct) provider(origin string) (Provider, error) {
+	if p, ok := self.providers[origin]; ok {
+		return p, nil
+	}
+	p, err := newProvider(origin)
+	if err != nil {
+		return nil, err
+	}
+	if cp, ok := p.(ChainedProvider); ok {
+		cp.SetChain(self)
+	}
+	if err := p.Init(); err != nil {
+		return nil, fmt.Errorf("unable to initialize provider %s: %v", origin, err)
+	}
+	if self.providers == nil {
+		self.providers = make(map[string]Provider)
+	}
+	self.providers[origin] = p
+	return p, nil
+}
+
+// Provider returns initialized provider for the origin, if the chain has used it
+func (self *SecretChainStruct) Provider(origin string) Provider {
+	return self.providers[lookupOrigin(origin)]
+}
+
+// UseProvider makes the chain use initialized provider p for its origin instead of one configured with the
+// environment, e.g. Vault provider with another role. The chain closes it on Close
+func (self *SecretChainStruct) UseProvider(p Provider) {
+	if self.providers == nil {
+		self.providers = make(map[string]Provider)
+	}
+	self.providers[lookupOrigin(p.Name())] = p
+}
+
+// InitProvider returns provider for the origin, initializing it on first use. Redirects don't apply,
+// it is meant for ChainedProvider which depends on that very provider
+func (self *SecretChainStruct) InitProvider(origin string) (Provider, error) {
+	if o := lookupOrigin(origin); o != "" {
+		origin = o
+	}
+	return self.provider(origin)
+}
+
+// Close closes all providers used by the chain
+func (self *SecretChainStruct) Close() error {
+	var first error
+	for origin, p := range self.providers {
+		if err := p.Close(); err != nil {
+			log.Errorf("unable to close provider %s: %v", origin, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	self.providers = nil
+	return first
+}
@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"strings"
 	"errors"
+	"net/url"
     "os"
+	"sort"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 
   "utils"
 )
@@ -23,12 +26,11 @@ const (
     vaultPathConst         = "VAULT_PATH"
 )
 
-var vaultOrigins          = [...]string {HcVaultVarName, AzureVaultVarName}
-
 
 // describes the structure of any Secret (vault-agnostic)
 type SecretStruct struct {
   Name          string // actual secret's name
+  Field         string // if set only this field (gjson path) of JSON secret is used
   Secret        string // actual secret value
   VaultPath     string // secret's path within the vault
   Encoding      string // method of encoding secret value
@@ -36,11 +38,19 @@ type SecretStruct struct {
   EnvVar        string // if set secret needs to be populated as Env Var
   File          string // if set secret needs to be populated as File
   FilePath      string // secret's path for secret file
+  Mode          os.FileMode       // permission mask of secret file, 0444 if not set
+  Options       map[string]string // origin/output specific options
+  ContentType   string            // content type of the secret value, if known
+  Values        map[string]string // secret's key/value pairs, if secret is expanded into many vars/files
+  Modes         map[string]os.FileMode // permission masks of files of Values by key, Mode if not set
+  Err           error `json:"-"`    // set if secret could not be retrieved
 }
 
 // struct describes the chain of secrets
 type SecretChainStruct struct {
   Secrets []SecretStruct
+  providers map[string]Provider // initialized providers, by origin
+  environ map[string]bool // env variables set before the secrets were injected
 }
 
 // generates brand new Chain of Secrets)
@@ -52,15 +62,43 @@ func NewSecretChain() (*SecretChainStruct, error){    // think of it as Chamber
   if err := scs.init(); err != nil {  // Huston, we have a problem
     return scs, errors.New( fmt.Sprintf("error: %s ", err.Error() ) )
   }
+  // declarative manifest, if any, goes on top of the env
+  if p := utils.GetEnvVariableByName( ManifestEnvVarName ); p != "" {
+    if err := scs.loadManifest(p); err != nil {
+      return scs, errors.New( fmt.Sprintf("error: %s ", err.Error() ) )
+    }
+  }
 
   return scs, nil
 }
 
+// NewSecretChainFromReferences returns chain of secrets given by references instead of the env, key -> reference
+// in the env variable syntax, e.g. DB_PASS -> secret/shared/db/mysql#password@hashicorpvault. Keys become EnvVar of
+// the secrets, e.g. keys of a Kubernetes Secret
+func NewSecretChainFromReferences(refs map[string]string) (*SecretChainStruct, error) {
+  scs := &SecretChainStruct{ Secrets: []SecretStruct{} }
+  keys := make([]string, 0, len(refs))
+  for k := range refs {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)  // keep errors stable
+  for _, k := range keys {
+    s, err := scs.parse(k, refs[k])
+    if err != nil || s.EnvVar == "" {  // file secrets come from SECRET_INJECTOR_SECRET_NAME_<n> env variables only
+      return nil, fmt.Errorf("invalid reference '%s' of %s, expected [path/]name[#field]@origin[?options]", refs[k], k)
+    }
+    scs.add(*s)
+  }
+  return scs, nil
+}
+
 // Initialize the secrets chain
 func (self *SecretChainStruct) init() error {
 
+  self.environ = make(map[string]bool)
   for _, pair := range os.Environ() { // go through env vars one by one
     kv := strings.SplitN( pair , "=" , 2 )  // and try to identify the patters
+    self.environ[kv[0]] = true
     if kv[0] != "" && kv[1] != "" {
 
       s, err := self.parse(kv[0], kv[1])
@@ -75,19 +113,24 @@ func (self *SecretChainStruct) init() error {
 //  assuming the pattern already detected
 func (self *SecretChainStruct) parse(key, val string) (*SecretStruct, error) {
   v := &SecretStruct{}
+  // options go last, e.g. mysql@hashicorpvault?expand=DB_
+  val, options := splitOptions(val)
+  v.Options = options
 
-  // check if var ends with "@<something>". Use vaultOrigins as list of all possible "something"s
-  if strings.Contains ( strings.ToLower(val), "@" ){  // might be env vars secrets..
-    for _, item := range vaultOrigins { // all possible "something"s
-      if strings.HasSuffix( strings.ToLower(val), strings.ToLower("@" + item) ) { // if matches.. this is kosher env variable secret
-        log.Debugf("--> parsing %s - %s , and it matches with %s", key, val, "@" + item)
-        v.Name = strings.TrimSuffix( strings.ToLower(val), strings.ToLower("@" + item) )
-        v.Origin = item
-        v.EnvVar = key
-        // lookup VAULT_PATH to find path within the vault (it could be empty and that's cool..  totaly cool..)
-        v.VaultPath = utils.GetEnvVariableByName( vaultPathConst )
-      }
+  // check if var ends with "@<something>". Registered providers make the list of all possible "something"s
+  if idx := strings.LastIndex( val, "@" ); idx >= 0 {  // might be env vars secrets..
+    item := lookupOrigin( val[idx+1:] )
+    if item == "" || idx == 0 {
+      return nil, errors.New( fmt.Sprintf("Skipping varibale: %s - unknown origin", key ) )
     }
+    // if matches.. this is kosher env variable secret
+    log.Debugf("--> parsing %s - %s , and it matches with %s", key, val, "@" + item)
+    v.Origin = item
+    v.EnvVar = key
+    // name could be full path within the vault or relative to VAULT_PATH, optionally followed by #field
+    ref, field := splitField( val[:idx] )
+    v.Name, v.VaultPath = splitVaultPath( ref, item )
+    v.Field = field
     return v, nil
   }else{  // now.. file secrets..:) here comes the bride..
 
@@ -99,7 +142,11 @@ func (self *SecretChainStruct) parse(key, val string) (*SecretStruct, error) {
       if v.Origin == "" {
         return v, errors.New( fmt.Sprintf("Missing Store System env variable for secret %s: '%s' - can not determine Vault origin. Skipping secret '%s'.", val, patternStoreSystem + secIndex, secIndex ) )
 
+      }else if origin := lookupOrigin( v.Origin ); origin == "" {
+        return v, errors.New( fmt.Sprintf("Unknown Store System '%s' for secret %s. Skipping secret '%s'.", v.Origin, val, secIndex ) )
+
       }else{  // aha! lets capture where this baby is coming from..
+        v.Origin = origin
 
         // look up second corresponding env var with name "secret_injector_mount_path_" + secIndex,
         //   to determine mount path for secret file
@@ -109,10 +156,10 @@ func (self *SecretChainStruct) parse(key, val string) (*SecretStruct, error) {
         }
         // ho-ho-ho, its Xmas time! Lets construct the name of the secret within the vault..
         // set actual name of secret within vault & file's name which is the same as the name of the secret.. no?
-        v.Name = val
-        v.File = val
-        // lookup VAULT_PATH to find path within the vault (it could be empty and thats cool..  totaly cool..)
-        v.VaultPath = utils.GetEnvVariableByName( vaultPathConst )   // Here's a little TODO: design how distinguish vault path across diff vaults (just in case of many vaults and potentialy diff types)
+        ref, field := splitField( val )
+        v.Name, v.VaultPath = splitVaultPath( ref, v.Origin )
+        v.Field = field
+        v.File = v.Name
       }
       return v, nil
     }
@@ -120,6 +167,109 @@ func (self *SecretChainStruct) parse(key, val string) (*SecretStruct, error) {
   return nil, errors.New( fmt.Sprintf("Skipping varibale: %s", key ) )
 }
 
+// splits secret reference into the name and the path within the vault.
+//  Reference containing '/' is a full path, e.g. secret/shared/db/mysql -> (mysql, secret/shared/db/).
+//  Otherwise it is a name relative to VAULT_PATH (it could be empty and thats cool..  totaly cool..),
+//  which applies to Hashicorp Vault only
+func splitVaultPath(ref, origin string) (string, string) {
+  if idx := strings.LastIndex( ref, "/" ); idx >= 0 {
+    return ref[idx+1:], ref[:idx+1]
+  }
+  if strings.EqualFold( origin, HcVaultVarName ) {
+    return ref, defaultVaultPath()
+  }
+  return ref, ""
+}
+
+// splits "<reference>?<options>" into the reference and options, which are URL query encoded,
+//  e.g. expand=DB_&dynamic. Options without value are set to ""
+func splitOptions(val string) (string, map[string]string) {
+  idx := strings.LastIndex( val, "?" )
+  if idx < 0 || idx < strings.LastIndex( val, "@" ) {
+    return val, nil
+  }
+  options := make(map[string]string)
+  if q, err := url.ParseQuery( val[idx+1:] ); err == nil {
+    for k, vs := range q {
+      options[k] = vs[0]
+    }
+  }
+  return val[:idx], options
+}
+
+// splits "<name>#<field>" reference into the name and the field
+func splitField(ref string) (string, string) {
+  if idx := strings.Index( ref, "#" ); idx >= 0 {
+    return ref[:idx], ref[idx+1:]
+  }
+  return ref, ""
+}
+
+// returns VAULT_PATH, always with trailing '/' unless empty
+func defaultVaultPath() string {
+  p := strings.TrimPrefix( utils.GetEnvVariableByName( vaultPathConst ), "/" )
+  if p != "" && !strings.HasSuffix( p, "/" ) {
+    p += "/"
+  }
+  return p
+}
+
+// DetectSecretPattern reports whether env variable key=val references a secret, either as
+//  "<name>@<origin>" value, as SECRET_INJECTOR_SECRET_NAME_<index> variable or points to the manifest.
+//  Unlike parse it does not look up any other env variables, so it can be used on foreign
+//  environments, e.g. env section of the pod spec
+func DetectSecretPattern(key, val string) bool {
+  if strings.HasPrefix( strings.ToLower(key), patternSecretName ) || strings.EqualFold( key, ManifestEnvVarName ) {
+    return val != ""
+  }
+  val, _ = splitOptions(val)
+  if idx := strings.LastIndex( val, "@" ); idx > 0 {
+    return lookupOrigin( val[idx+1:] ) != ""
+  }
+  return false
+}
+
+// SetSecret sets value of the secret, selecting the Field from it if needed.
+//  If secret is to be expanded (option "expand"), its JSON keys are populated into Values
+func (s *SecretStruct) SetSecret(value string) error {
+  if s.Field != "" {
+    selected, err := SelectField( value, s.Field )
+    if err != nil {
+      return errors.New( fmt.Sprintf("secret '%s': %s", s.Name, err.Error() ) )
+    }
+    value = selected
+  }
+  s.Secret = value
+  if _, ok := s.Options[OptionExpand]; ok {
+    if s.ContentType != "" && !strings.Contains( strings.ToLower(s.ContentType), "json" ) {
+      return errors.New( fmt.Sprintf("secret '%s' can't be expanded, its content type '%s' is not JSON", s.Name, s.ContentType ) )
+    }
+    values, err := expandJSON( value )
+    if err != nil {
+      return errors.New( fmt.Sprintf("secret '%s' can't be expanded: %s", s.Name, err.Error() ) )
+    }
+    s.Values = values
+  }
+  return nil
+}
+
+// SelectField returns field of JSON document secret. Field is gjson path, e.g. "username",
+//  "db.primary.password", "hosts.0" or "tls\.crt" for keys with dots. String values are returned raw,
+//  everything else (objects, arrays, numbers..) as JSON
+func SelectField(secret, field string) (string, error) {
+  if !gjson.Valid( secret ) {
+    return "", errors.New( fmt.Sprintf("value is not JSON, can not select field '%s'", field ) )
+  }
+  r := gjson.Get( secret, field )
+  if !r.Exists() {
+    return "", errors.New( fmt.Sprintf("field '%s' not found", field ) )
+  }
+  if r.Type == gjson.String {
+    return r.Str, nil
+  }
+  return r.Raw, nil
+}
+
 // adding new secret into the chain with the key as "name-of-the-secret:origin-vault"
 //  secrets may have the same names across the vaults
 func (self *SecretChainStruct) add(s SecretStruct) {
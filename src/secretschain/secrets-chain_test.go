@@ -0,0 +1,300 @@
+package secretschain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeProvider serves secrets from the map, keyed by full path
+type fakeProvider struct {
+	origin  string
+	secrets map[string]string
+	inits   int
+}
+
+func (p *fakeProvider) Name() string { return p.origin }
+func (p *fakeProvider) Init() error  { p.inits++; return nil }
+func (p *fakeProvider) Close() error { return nil }
+func (p *fakeProvider) Fetch(secrets []*SecretStruct) error {
+	for _, s := range secrets {
+		v, ok := p.secrets[s.VaultPath+s.Name]
+		if !ok {
+			s.Fail(fmt.Errorf("not found"))
+			continue
+		}
+		if err := s.SetSecret(v); err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+var fakeSecrets = map[string]string{
+	"secret/shared/db/mysql": `{"username":"appuser","password":"s3cr3t"}`,
+	"db2password":            "db2s3cr3t",
+}
+
+func init() {
+	for _, origin := range []string{HcVaultVarName, AzureVaultVarName} {
+		o := origin
+		RegisterProvider(o, func() Provider { return &fakeProvider{origin: o, secrets: fakeSecrets} })
+	}
+}
+
+func writeManifest(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "secretschain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "secrets.yaml")
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestManifestMergedWithEnv(t *testing.T) {
+	t.Log("Testing manifest secrets are merged with env secrets")
+	os.Setenv("MYDB2_CREDS", "mysql@hashicorpvault")
+	os.Setenv("OTHER_CREDS", "other@hashicorpvault")
+	defer os.Unsetenv("MYDB2_CREDS")
+	defer os.Unsetenv("OTHER_CREDS")
+
+	p := writeManifest(t, `
+secrets:
+- name: mysql-v2
+  origin: HashicorpVault
+  vaultPath: secret/shared/
+  env: MYDB2_CREDS
+- name: db2password
+  origin: azurekeyvault
+  file: /etc/secrets/db2
+  mode: "0400"
+`)
+	defer os.RemoveAll(filepath.Dir(p))
+	os.Setenv(ManifestEnvVarName, p)
+	defer os.Unsetenv(ManifestEnvVarName)
+
+	chain, err := NewSecretChain()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := make(map[string]SecretStruct)
+	for _, s := range chain.Secrets {
+		found[s.Name] = s
+	}
+	if _, ok := found["mysql"]; ok {
+		t.Errorf("env secret for MYDB2_CREDS should be replaced by manifest entry")
+	}
+	if s, ok := found["mysql-v2"]; !ok || s.Origin != HcVaultVarName || s.VaultPath != "secret/shared/" {
+		t.Errorf("manifest secret mysql-v2 is missing or wrong: %+v", s)
+	}
+	if _, ok := found["other"]; !ok {
+		t.Errorf("env secret OTHER_CREDS should be kept")
+	}
+	if s := found["db2password"]; s.Origin != AzureVaultVarName || s.FilePath != "/etc/secrets/" || s.File != "db2" || s.Mode != 0400 {
+		t.Errorf("manifest file secret is wrong: %+v", s)
+	}
+}
+
+func TestManifestRejectsTypos(t *testing.T) {
+	t.Log("Testing manifest validation")
+	for _, m := range []string{
+		"secrets:\n- name: mysql\n  origin: hashicorpvault\n  evn: MYDB2_CREDS\n",
+		"secrets:\n- name: mysql\n  origin: hashicorp\n  env: MYDB2_CREDS\n",
+		"secrets:\n- name: mysql\n  origin: hashicorpvault\n",
+		"secrets:\n- name: mysql\n  origin: hashicorpvault\n  file: /etc/secrets/mysql\n  mode: rw\n",
+	} {
+		p := writeManifest(t, m)
+		chain := &SecretChainStruct{}
+		if err := chain.loadManifest(p); err == nil {
+			t.Errorf("manifest should be rejected:\n%s", m)
+		}
+		os.RemoveAll(filepath.Dir(p))
+	}
+}
+
+func TestParseVaultPath(t *testing.T) {
+	t.Log("Testing per-secret vault path")
+	os.Setenv("VAULT_PATH", "secret/appCodes/app/dev")
+	defer os.Unsetenv("VAULT_PATH")
+	os.Setenv("SECRET_STORE_SYSTEM_7", "hashicorpvault")
+	os.Setenv("SECRET_INJECTOR_MOUNT_PATH_7", "/etc/secrets")
+	defer os.Unsetenv("SECRET_STORE_SYSTEM_7")
+	defer os.Unsetenv("SECRET_INJECTOR_MOUNT_PATH_7")
+
+	chain := &SecretChainStruct{}
+	for _, tc := range []struct {
+		key, val, name, vaultPath string
+	}{
+		{"DB_PASS", "secret/shared/db/MySQL@hashicorpvault", "MySQL", "secret/shared/db/"},
+		{"APP_CREDS", "mysql@HashicorpVault", "mysql", "secret/appCodes/app/dev/"},
+		{"AZ_CREDS", "db2password@AzureKeyVault", "db2password", ""},
+		{"SECRET_INJECTOR_SECRET_NAME_7", "secret/shared/tls/cert", "cert", "secret/shared/tls/"},
+	} {
+		s, err := chain.parse(tc.key, tc.val)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s=%s: %v", tc.key, tc.val, err)
+		}
+		if s.Name != tc.name || s.VaultPath != tc.vaultPath {
+			t.Errorf("%s=%s parsed into name %q, path %q; expected %q, %q", tc.key, tc.val, s.Name, s.VaultPath, tc.name, tc.vaultPath)
+		}
+	}
+	if _, err := chain.parse("EMAIL", "admin@example.com"); err == nil {
+		t.Errorf("value with unknown origin should be skipped")
+	}
+}
+
+func TestSelectField(t *testing.T) {
+	t.Log("Testing field selection from JSON secrets")
+	secret := `{"username":"appuser","password":"s3cr3t","db":{"primary":{"port":3306}},"hosts":["a","b"],"tls.crt":"PEM"}`
+	for field, expected := range map[string]string{
+		"username":        "appuser",
+		"db.primary.port": "3306",
+		"db.primary":      `{"port":3306}`,
+		"hosts.1":         "b",
+		`tls\.crt`:        "PEM",
+	} {
+		if v, err := SelectField(secret, field); err != nil || v != expected {
+			t.Errorf("field %s: expected %q, got %q (%v)", field, expected, v, err)
+		}
+	}
+	if _, err := SelectField(secret, "missing"); err == nil {
+		t.Errorf("missing field should be reported")
+	}
+	if _, err := SelectField("not json", "username"); err == nil {
+		t.Errorf("selecting field of non-JSON secret should fail")
+	}
+
+	chain := &SecretChainStruct{}
+	s, err := chain.parse("DB_USER", "secret/shared/db/mysql#username@hashicorpvault")
+	if err != nil || s.Name != "mysql" || s.Field != "username" || s.VaultPath != "secret/shared/db/" {
+		t.Fatalf("unexpected parse result: %+v (%v)", s, err)
+	}
+	if err := s.SetSecret(secret); err != nil || s.Secret != "appuser" {
+		t.Errorf("expected selected field, got %q (%v)", s.Secret, err)
+	}
+}
+
+func TestExpandSecret(t *testing.T) {
+	t.Log("Testing expansion of secret into many env variables")
+	chain := &SecretChainStruct{environ: map[string]bool{"DB_HOST": true}} // DB_HOST was set before injection
+	s, err := chain.parse("MYDB", "mysql@hashicorpvault?expand=DB_")
+	if err != nil || s.Name != "mysql" {
+		t.Fatalf("unexpected parse result: %+v (%v)", s, err)
+	}
+	if prefix, ok := s.Options[OptionExpand]; !ok || prefix != "DB_" {
+		t.Fatalf("expand option is not parsed: %v", s.Options)
+	}
+	s.ContentType = "application/json"
+	if err := s.SetSecret(`{"username":"appuser","pass-word":"s3cr3t","host":"db","port":3306}`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chain.add(*s)
+	chain.add(SecretStruct{Name: "other", EnvVar: "DB_USERNAME", Secret: "x"})
+
+	env, errs := chain.Environment()
+	if env["DB_PASS_WORD"] != "s3cr3t" || env["DB_PORT"] != "3306" {
+		t.Errorf("secret is not expanded: %v", env)
+	}
+	if env["DB_USERNAME"] != "x" || env["DB_HOST"] != "" {
+		t.Errorf("expanded keys must not override other secrets or existing env variables: %v", env)
+	}
+	if len(errs) != 2 {
+		t.Errorf("expected 2 collisions, got: %v", errs)
+	}
+	if _, ok := env["MYDB"]; ok {
+		t.Errorf("expanded secret should not set its own env variable: %v", env)
+	}
+
+	t.Log("Testing re-resolution after injection")
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	if _, errs := chain.Environment(); len(errs) != 2 {
+		t.Errorf("injected secrets should not clash with themselves, got: %v", errs)
+	}
+
+	az := &SecretStruct{Name: "cfg", ContentType: "text/plain", Options: map[string]string{OptionExpand: ""}}
+	if err := az.SetSecret(`{"a":"b"}`); err == nil {
+		t.Errorf("secret with non-JSON content type should not be expanded")
+	}
+	if EnvName("", "db/primary.host") != "DB_PRIMARY_HOST" {
+		t.Errorf("unexpected env name: %s", EnvName("", "db/primary.host"))
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Log("Testing dispatching of secrets to providers")
+	chain := &SecretChainStruct{}
+	for k, v := range map[string]string{
+		"DB_USER":  "secret/shared/db/mysql#username@hashicorpvault",
+		"DB2_PASS": "db2password@azurekeyvault",
+		"MISSING":  "secret/shared/db/none@hashicorpvault",
+	} {
+		s, err := chain.parse(k, v)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", k, err)
+		}
+		chain.add(*s)
+	}
+	if _, err := chain.parse("X", "y@unknownvault"); err == nil {
+		t.Errorf("reference to unregistered origin should be skipped")
+	}
+
+	err := chain.Resolve()
+	if err == nil {
+		t.Errorf("missing secret should be reported")
+	}
+	env, _ := chain.Environment()
+	if env["DB_USER"] != "appuser" || env["DB2_PASS"] != "db2s3cr3t" {
+		t.Errorf("secrets are not resolved: %v", env)
+	}
+	if _, ok := env["MISSING"]; ok {
+		t.Errorf("failed secret should not be exported: %v", env)
+	}
+	if failed := chain.Failed(); len(failed) != 1 || failed[0].EnvVar != "MISSING" {
+		t.Errorf("expected exactly one failed secret, got %v", failed)
+	}
+
+	// providers are reused on the next round
+	_ = chain.Resolve()
+	if p := chain.Provider(HcVaultVarName).(*fakeProvider); p.inits != 1 {
+		t.Errorf("provider should be initialized once, got %d", p.inits)
+	}
+	// partial refresh leaves other secrets alone
+	if err := chain.ResolveWhere(func(s *SecretStruct) bool { return s.Origin == AzureVaultVarName }); err != nil {
+		t.Errorf("unexpected error refreshing secrets of %s: %v", AzureVaultVarName, err)
+	}
+	if err := chain.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewSecretChainFromReferences(t *testing.T) {
+	t.Log("Testing chain of references")
+	chain, err := NewSecretChainFromReferences(map[string]string{
+		"password": "secret/shared/db/mysql#password@hashicorpvault",
+		"db2":      "db2password@AzureKeyVault",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := chain.Resolve(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	env, errs := chain.Environment()
+	if len(errs) > 0 || env["password"] != "s3cr3t" || env["db2"] != "db2s3cr3t" {
+		t.Errorf("unexpected values %v, errors %v", env, errs)
+	}
+
+	for _, ref := range []string{"plain value", "mysql@unknown", "@hashicorpvault"} {
+		if _, err := NewSecretChainFromReferences(map[string]string{"key": ref}); err == nil {
+			t.Errorf("reference %q should be rejected", ref)
+		}
+	}
+}
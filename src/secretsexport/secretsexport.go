@@ -0,0 +1,186 @@
+// Package secretsexport formats resolved secrets for use outside of secret-injector's own process,
+// e.g. dotenv file on a volume shared with the application container, `eval` in shell scripts,
+// docker --env-file or Kubernetes Secret manifest for kubectl apply.
+//
+// Formats differ in quoting, each fits its consumer only: dotenv is for dotenv libraries (double quotes with
+// escapes, never sourced by a shell, which would expand $ in them), shell is for eval (single quotes) and
+// docker-env is for docker --env-file, which takes everything after '=' literally.
+//
+
+package secretsexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Formats
+const (
+	FormatDotenv           = "dotenv"
+	FormatDockerEnv        = "docker-env"
+	FormatShell            = "shell"
+	FormatJSON             = "json"
+	FormatKubernetesSecret = "k8s-secret"
+)
+
+// Formats returns names of the supported formats
+func Formats() []string {
+	return []string{FormatDotenv, FormatDockerEnv, FormatShell, FormatJSON, FormatKubernetesSecret}
+}
+
+// Options of the formats
+type Options struct {
+	Name      string // name of Kubernetes Secret
+	Namespace string // namespace of Kubernetes Secret, optional
+}
+
+// Format returns values formatted as format
+func Format(format string, values map[string]string, o Options) ([]byte, error) {
+	switch format {
+	case FormatDotenv:
+		return Dotenv(values), nil
+	case FormatDockerEnv:
+		return DockerEnv(values)
+	case FormatShell:
+		return Shell(values), nil
+	case FormatJSON:
+		return JSON(values)
+	case FormatKubernetesSecret:
+		return KubernetesSecret(values, o)
+	}
+	return nil, fmt.Errorf("unknown format %s, expected one of %s", format, strings.Join(Formats(), ", "))
+}
+
+// values which need no quoting in dotenv
+var plainValue = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+// Dotenv returns KEY=VALUE lines sorted by key. Values are double-quoted with \\, \", \n, \r and \t escapes
+// when needed, as read by secretsinjector.ParseDotenv and the usual dotenv libraries. Not for docker --env-file,
+// which keeps the quotes, nor for shells, which expand $ in double quotes; see DockerEnv and Shell
+func Dotenv(env map[string]string) []byte {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(env) {
+		b.WriteString(k + "=" + dotenvQuote(env[k]) + "\n")
+	}
+	return b.Bytes()
+}
+
+// quotes value of dotenv line, if needed
+func dotenvQuote(v string) string {
+	if plainValue.MatchString(v) {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(v) + `"`
+}
+
+// DockerEnv returns KEY=VALUE lines sorted by key for docker --env-file, which reads values literally,
+// quotes included. Values with line breaks can't be written that way and fail
+func DockerEnv(env map[string]string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(env) {
+		if strings.ContainsAny(env[k], "\r\n") {
+			return nil, fmt.Errorf("value of %s has line breaks, which docker --env-file can't read, use %s or %s", k, FormatJSON, FormatKubernetesSecret)
+		}
+		b.WriteString(k + "=" + env[k] + "\n")
+	}
+	return b.Bytes(), nil
+}
+
+// Shell returns `export KEY='VALUE'` lines sorted by key, for eval in POSIX shells. Values are single-quoted,
+// so nothing in them is expanded
+func Shell(env map[string]string) []byte {
+	var b bytes.Buffer
+	for _, k := range sortedKeys(env) {
+		b.WriteString("export " + k + "=" + shellQuote(env[k]) + "\n")
+	}
+	return b.Bytes()
+}
+
+// single-quotes v for POSIX shells, single quotes in v are closed, escaped and reopened
+func shellQuote(v string) string {
+	return "'" + strings.Replace(v, "'", `'\''`, -1) + "'"
+}
+
+// JSON returns values as JSON object
+func JSON(values map[string]string) ([]byte, error) {
+	b, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// KubernetesSecret returns manifest of Opaque Secret with the values, for kubectl apply
+func KubernetesSecret(values map[string]string, o Options) ([]byte, error) {
+	if o.Name == "" {
+		return nil, fmt.Errorf("name of the Kubernetes Secret is required")
+	}
+	secret := NewKubernetesSecret(values, o)
+	return yaml.Marshal(secret)
+}
+
+// NewKubernetesSecret returns Opaque Secret with the values
+func NewKubernetesSecret(values map[string]string, o Options) *corev1.Secret {
+	data := make(map[string][]byte, len(values))
+	for k, v := range values {
+		data[k] = []byte(v)
+	}
+	return &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       data,
+	}
+}
+
+// returns keys of m, sorted
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteFile writes data to file name atomically (temporary file in the same directory, synced to disk and renamed
+// over it) with permission mask mode, creating the directory if needed. Readers never see half-written file
+func WriteFile(name string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())             // no-op after rename
+	if err := tmp.Chmod(mode); err != nil { // before the content is written
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,153 @@
+package secretsexport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	secinject "secretsinjector"
+)
+
+var env = map[string]string{
+	"DB_USER":     "appuser",
+	"DB_PASSWORD": `p@ss "word" $HOME\n 'quoted'`,
+	"TLS_CERT":    "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	"EMPTY":       "",
+}
+
+func TestDotenv(t *testing.T) {
+	t.Log("Testing dotenv output")
+	out := string(Dotenv(env))
+	expected := "DB_PASSWORD=\"p@ss \\\"word\\\" $HOME\\\\n 'quoted'\"\n" +
+		"DB_USER=appuser\n" +
+		"EMPTY=\n" +
+		"TLS_CERT=\"-----BEGIN CERTIFICATE-----\\nMIIB\\n-----END CERTIFICATE-----\\n\"\n"
+	if out != expected {
+		t.Errorf("unexpected dotenv:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	t.Log("Testing dotenv round trip with ParseDotenv")
+	parsed, err := secinject.ParseDotenv([]byte(out))
+	if err != nil {
+		t.Fatalf("ParseDotenv failed: %v", err)
+	}
+	for k, v := range env {
+		if parsed[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, parsed[k])
+		}
+	}
+}
+
+func TestDockerEnv(t *testing.T) {
+	t.Log("Testing docker --env-file output keeps values literally")
+	out, err := DockerEnv(map[string]string{"DB_PASSWORD": `p@ss "word" $HOME`, "EMPTY": ""})
+	expected := "DB_PASSWORD=p@ss \"word\" $HOME\nEMPTY=\n"
+	if err != nil || string(out) != expected {
+		t.Errorf("unexpected docker env file:\n%s\nexpected:\n%s (%v)", out, expected, err)
+	}
+
+	t.Log("Testing values with line breaks are rejected")
+	if _, err := Format(FormatDockerEnv, env, Options{}); err == nil {
+		t.Errorf("multi-line value should fail")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	t.Log("Testing WriteFile permissions and content")
+	dir, err := ioutil.TempDir("", "secretsexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "sub", ".env")
+	for _, content := range []string{"A=1\n", "A=2\n"} { // second write replaces the file
+		if err := WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		b, _ := ioutil.ReadFile(name)
+		if string(b) != content {
+			t.Errorf("expected %q, got %q", content, b)
+		}
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %o", fi.Mode().Perm())
+	}
+	if err := WriteFile(name, []byte("A=3\n"), 0444); err != nil { // read-only file is replaced too
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if fi, _ := os.Stat(name); fi.Mode().Perm() != 0444 {
+		t.Errorf("expected mode 0444, got %o", fi.Mode().Perm())
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Dir(name)); len(entries) != 1 {
+		t.Errorf("expected no temporary files left, got %d entries", len(entries))
+	}
+}
+
+func TestShell(t *testing.T) {
+	t.Log("Testing shell output is evaluated to the same values")
+	out := string(Shell(env))
+	for k, v := range env {
+		b, err := exec.Command("/bin/sh", "-c", out+`printf '%s' "$`+k+`"`).Output()
+		if err != nil {
+			t.Fatalf("sh failed: %v\n%s", err, out)
+		}
+		if string(b) != v {
+			t.Errorf("%s: expected %q, got %q", k, v, b)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	t.Log("Testing JSON output")
+	b, err := JSON(env)
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	for k, v := range env {
+		if m[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, m[k])
+		}
+	}
+}
+
+func TestKubernetesSecret(t *testing.T) {
+	t.Log("Testing Kubernetes Secret manifest")
+	if _, err := KubernetesSecret(env, Options{}); err == nil {
+		t.Errorf("expected error for missing name")
+	}
+	b, err := Format(FormatKubernetesSecret, env, Options{Name: "app-secrets", Namespace: "apps"})
+	if err != nil {
+		t.Fatalf("Format failed: %v", err)
+	}
+	var secret corev1.Secret
+	if err := yaml.Unmarshal(b, &secret); err != nil {
+		t.Fatalf("invalid manifest: %v\n%s", err, b)
+	}
+	if secret.Kind != "Secret" || secret.APIVersion != "v1" || secret.Name != "app-secrets" || secret.Namespace != "apps" || secret.Type != corev1.SecretTypeOpaque {
+		t.Errorf("unexpected Secret metadata:\n%s", b)
+	}
+	for k, v := range env {
+		if string(secret.Data[k]) != v {
+			t.Errorf("%s: expected %q, got %q", k, v, secret.Data[k])
+		}
+	}
+
+	if _, err := Format("xml", env, Options{}); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
@@ -0,0 +1,126 @@
+// Package provides capabilities to retrieve secrets from AWS Secrets Manager
+//
+
+package secretsinjector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	AwsSecretsManagerVarName      = "awssecretsmanager"
+	AwsSecretsManagerEndpointName = "AWS_SECRETSMANAGER_ENDPOINT" // endpoint override, e.g. for local stubs
+	OptionVersionStage            = "stage"                       // e.g. ?stage=AWSPREVIOUS
+	OptionVersionID               = "version"                     // e.g. ?version=<version id>
+)
+
+// AWS Secrets Manager struct
+type AwsSecretsManagerClientStruct struct {
+	Client secretsmanageriface.SecretsManagerAPI
+}
+
+func init() {
+	secretschain.RegisterProvider(AwsSecretsManagerVarName, func() secretschain.Provider { return &AwsSecretsManagerClientStruct{} })
+}
+
+// Name of the origin
+func (v *AwsSecretsManagerClientStruct) Name() string {
+	return AwsSecretsManagerVarName
+}
+
+// Init creates Secrets Manager client. Credentials come from the standard chain:
+// env variables, web identity (AWS_ROLE_ARN + AWS_WEB_IDENTITY_TOKEN_FILE, i.e. EKS IRSA), shared config and instance role
+func (v *AwsSecretsManagerClientStruct) Init() error {
+	if v.Client != nil {
+		return nil // already set, e.g. by tests
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	cfg := aws.NewConfig()
+	if ep := utils.GetEnvVariableByName(AwsSecretsManagerEndpointName); ep != "" {
+		log.Debugf("using AWS Secrets Manager endpoint: %s", ep)
+		cfg = cfg.WithEndpoint(ep)
+	}
+	v.Client = secretsmanager.New(sess, cfg)
+	return nil
+}
+
+// Fetch secrets from Secrets Manager. Secret id is the name or ARN of the secret
+func (v *AwsSecretsManagerClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		id := s.VaultPath + s.Name
+		input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)}
+		if stage := s.Options[OptionVersionStage]; stage != "" {
+			input.VersionStage = aws.String(stage)
+		}
+		if version := s.Options[OptionVersionID]; version != "" {
+			input.VersionId = aws.String(version)
+		}
+
+		log.Debugf("retrieving secret %s from AWS Secrets Manager", id)
+		out, err := v.Client.GetSecretValueWithContext(context.Background(), input)
+		if err != nil {
+			s.Fail(awsError(id, err))
+			continue
+		}
+		if out.SecretString != nil {
+			s.ContentType = "" // string secrets are usually, but not necessarily, JSON
+			err = s.SetSecret(*out.SecretString)
+		} else if s.FilePath == "" {
+			err = fmt.Errorf("secret %s is binary and can be written to secret files only", id)
+		} else {
+			s.ContentType = "application/octet-stream"
+			err = s.SetSecret(string(out.SecretBinary)) // raw bytes, fine for secret files
+		}
+		if err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Close the provider
+func (v *AwsSecretsManagerClientStruct) Close() error {
+	return nil
+}
+
+// returns AWS session with standard credentials chain and region from the environment
+func awsSession() (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AWS session: %v", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		return nil, fmt.Errorf("AWS region is not set, set AWS_REGION")
+	}
+	return sess, nil
+}
+
+// turns AWS API errors into messages which tell missing secrets from denied ones
+func awsError(id string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "ResourceNotFoundException", "ParameterNotFound", "ParameterVersionNotFound":
+			return fmt.Errorf("secret %s not found", id)
+		case "AccessDeniedException":
+			return fmt.Errorf("access to secret %s denied: %s", id, aerr.Message())
+		case "DecryptionFailure", "InvalidKeyId":
+			return fmt.Errorf("unable to decrypt secret %s: %s", id, aerr.Message())
+		}
+	}
+	return fmt.Errorf("unable to retrieve secret %s: %v", id, err)
+}
@@ -0,0 +1,91 @@
+package secretsinjector
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"secretschain"
+)
+
+// stubs GetSecretValue of AWS Secrets Manager JSON API
+func newSecretsManagerStub(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "secretsmanager.GetSecretValue" {
+			t.Errorf("unexpected API call: %s", target)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		req := struct {
+			SecretId     string
+			VersionId    string
+			VersionStage string
+		}{}
+		_ = json.Unmarshal(body, &req)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch {
+		case req.SecretId == "prod/db" && req.VersionStage == "AWSPREVIOUS":
+			_, _ = w.Write([]byte(`{"Name":"prod/db","SecretString":"{\"username\":\"olduser\",\"password\":\"old\"}"}`))
+		case req.SecretId == "prod/db":
+			_, _ = w.Write([]byte(`{"Name":"prod/db","SecretString":"{\"username\":\"appuser\",\"password\":\"s3cr3t\"}"}`))
+		case req.SecretId == "prod/keystore":
+			_, _ = w.Write([]byte(`{"Name":"prod/keystore","SecretBinary":"` + base64.StdEncoding.EncodeToString([]byte{0xca, 0xfe, 0x00}) + `"}`))
+		case req.SecretId == "prod/denied":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"AccessDeniedException","message":"not authorized"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`))
+		}
+	}))
+}
+
+func TestAwsSecretsManagerFetch(t *testing.T) {
+	t.Log("Testing AWS Secrets Manager provider against local stub")
+	stub := newSecretsManagerStub(t)
+	defer stub.Close()
+	for k, v := range map[string]string{
+		AwsSecretsManagerEndpointName: stub.URL,
+		"AWS_REGION":                  "us-east-1",
+		"AWS_ACCESS_KEY_ID":           "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY":       "secret",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	p := &AwsSecretsManagerClientStruct{}
+	if err := p.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "db", VaultPath: "prod/", Field: "password"},
+		{Name: "db", VaultPath: "prod/", Field: "username", Options: map[string]string{OptionVersionStage: "AWSPREVIOUS"}},
+		{Name: "keystore", VaultPath: "prod/", FilePath: "/etc/secrets/"},
+		{Name: "denied", VaultPath: "prod/"},
+		{Name: "missing", VaultPath: "prod/"},
+		{Name: "keystore", VaultPath: "prod/", EnvVar: "KEYSTORE"},
+	}
+	if err := p.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "s3cr3t" || secrets[0].Err != nil {
+		t.Errorf("expected selected password, got %q (%v)", secrets[0].Secret, secrets[0].Err)
+	}
+	if secrets[1].Secret != "olduser" {
+		t.Errorf("expected username of AWSPREVIOUS version, got %q (%v)", secrets[1].Secret, secrets[1].Err)
+	}
+	if secrets[2].Secret != string([]byte{0xca, 0xfe, 0x00}) {
+		t.Errorf("binary secret is not preserved: %q (%v)", secrets[2].Secret, secrets[2].Err)
+	}
+	if secrets[3].Err == nil || secrets[4].Err == nil {
+		t.Errorf("denied and missing secrets should fail")
+	}
+	if secrets[5].Err == nil || secrets[5].Secret != "" {
+		t.Errorf("binary secret should not be set as env variable, got %q", secrets[5].Secret)
+	}
+}
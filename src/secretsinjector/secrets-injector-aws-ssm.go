@@ -0,0 +1,148 @@
+// Package provides capabilities to retrieve parameters from AWS SSM Parameter Store
+//
+
+package secretsinjector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	AwsSsmVarName      = "awsssm"
+	AwsSsmEndpointName = "AWS_SSM_ENDPOINT" // endpoint override, e.g. for local stubs
+	OptionRecursive    = "recursive"        // prefix mode only, default is true
+)
+
+// AWS SSM Parameter Store struct
+type AwsSsmClientStruct struct {
+	Client ssmiface.SSMAPI
+}
+
+func init() {
+	secretschain.RegisterProvider(AwsSsmVarName, func() secretschain.Provider { return &AwsSsmClientStruct{} })
+}
+
+// Name of the origin
+func (v *AwsSsmClientStruct) Name() string {
+	return AwsSsmVarName
+}
+
+// Init creates SSM client, credentials come from the standard chain (see AwsSecretsManagerClientStruct.Init)
+func (v *AwsSsmClientStruct) Init() error {
+	if v.Client != nil {
+		return nil // already set, e.g. by tests
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	cfg := aws.NewConfig()
+	if ep := utils.GetEnvVariableByName(AwsSsmEndpointName); ep != "" {
+		log.Debugf("using AWS SSM endpoint: %s", ep)
+		cfg = cfg.WithEndpoint(ep)
+	}
+	v.Client = ssm.New(sess, cfg)
+	return nil
+}
+
+// Fetch parameters. Reference ending with '/' (e.g. /app/prod/@awsssm) loads every parameter under
+// the path, otherwise single parameter is loaded. SecureString parameters are always decrypted
+func (v *AwsSsmClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		var err error
+		if s.Name == "" {
+			err = v.fetchPath(s)
+		} else {
+			err = v.fetchParameter(s)
+		}
+		if err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Close the provider
+func (v *AwsSsmClientStruct) Close() error {
+	return nil
+}
+
+// loads single parameter, name may carry version or label, e.g. /app/prod/db_password:3
+func (v *AwsSsmClientStruct) fetchParameter(s *secretschain.SecretStruct) error {
+	name := s.VaultPath + s.Name
+	log.Debugf("retrieving parameter %s from AWS SSM", name)
+	out, err := v.Client.GetParameterWithContext(context.Background(), &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return awsError(name, err)
+	}
+	return s.SetSecret(aws.StringValue(out.Parameter.Value))
+}
+
+// loads all parameters under the path, page by page. Keys of the values are names relative to the path,
+// so /app/prod/db_password becomes db_password, i.e. env variable DB_PASSWORD
+func (v *AwsSsmClientStruct) fetchPath(s *secretschain.SecretStruct) error {
+	prefix := s.VaultPath
+	if s.Field != "" {
+		return fmt.Errorf("field '%s' can't be selected from parameters under %s, reference the parameter instead", s.Field, prefix)
+	}
+	recursive := true
+	if r, ok := s.Options[OptionRecursive]; ok && r != "" {
+		b, err := strconv.ParseBool(r)
+		if err != nil {
+			return err
+		}
+		recursive = b
+	}
+
+	log.Debugf("retrieving parameters under %s from AWS SSM (recursive: %t)", prefix, recursive)
+	values := make(map[string]string)
+	err := v.Client.GetParametersByPathPagesWithContext(context.Background(), &ssm.GetParametersByPathInput{
+		Path:           aws.String(strings.TrimSuffix(prefix, "/")),
+		Recursive:      aws.Bool(recursive),
+		WithDecryption: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, last bool) bool {
+		for _, p := range page.Parameters {
+			key := strings.TrimPrefix(aws.StringValue(p.Name), prefix)
+			values[key] = aws.StringValue(p.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return awsError(prefix, err)
+	}
+	if len(values) == 0 {
+		log.Warningf("no parameters found under %s", prefix)
+	}
+
+	j, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	s.Secret = string(j)
+	s.Values = values
+	if s.EnvVar != "" {
+		if s.Options == nil {
+			s.Options = make(map[string]string)
+		}
+		if _, ok := s.Options[secretschain.OptionExpand]; !ok {
+			s.Options[secretschain.OptionExpand] = "" // path references are always expanded
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package secretsinjector
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	"secretschain"
+)
+
+// serves GetParametersByPath in pages of one parameter, GetParameter returns SecureString parameters
+// encrypted unless decryption is asked for
+type fakeSsm struct {
+	ssmiface.SSMAPI
+	params map[string]string
+}
+
+func (f *fakeSsm) GetParameterWithContext(ctx aws.Context, in *ssm.GetParameterInput, opts ...request.Option) (*ssm.GetParameterOutput, error) {
+	value, ok := f.params[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	if !aws.BoolValue(in.WithDecryption) {
+		value = "AQICAHh0ZW5jcnlwdGVk"
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Type: aws.String(ssm.ParameterTypeSecureString), Value: aws.String(value)}}, nil
+}
+
+func (f *fakeSsm) GetParametersByPathPagesWithContext(ctx aws.Context, in *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool, opts ...request.Option) error {
+	if !aws.BoolValue(in.WithDecryption) || !aws.BoolValue(in.Recursive) {
+		panic("parameters must be loaded recursively and decrypted")
+	}
+	pages := []*ssm.GetParametersByPathOutput{}
+	for name, value := range f.params {
+		pages = append(pages, &ssm.GetParametersByPathOutput{Parameters: []*ssm.Parameter{{Name: aws.String(name), Value: aws.String(value)}}})
+	}
+	for idx, page := range pages {
+		if !fn(page, idx == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestAwsSsmFetchPath(t *testing.T) {
+	t.Log("Testing recursive loading of SSM parameters under the path")
+	p := &AwsSsmClientStruct{Client: &fakeSsm{params: map[string]string{
+		"/app/prod/db_password": "s3cr3t",
+		"/app/prod/db/host":     "db.example.com",
+		"/app/prod/api-key":     "k3y",
+	}}}
+	if err := p.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := &secretschain.SecretStruct{Name: "", VaultPath: "/app/prod/", EnvVar: "APP_CONFIG", Origin: AwsSsmVarName}
+	if err := p.Fetch([]*secretschain.SecretStruct{s}); err != nil || s.Err != nil {
+		t.Fatalf("unexpected error: %v %v", err, s.Err)
+	}
+
+	chain := &secretschain.SecretChainStruct{Secrets: []secretschain.SecretStruct{*s}}
+	env, errs := chain.Environment()
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for name, value := range map[string]string{"DB_PASSWORD": "s3cr3t", "DB_HOST": "db.example.com", "API_KEY": "k3y"} {
+		if env[name] != value {
+			t.Errorf("expected %s=%s, got %q", name, value, env[name])
+		}
+	}
+	if s.Values["db/host"] != "db.example.com" {
+		t.Errorf("file keys should be relative to the path: %v", s.Values)
+	}
+}
+
+func TestAwsSsmFetchParameter(t *testing.T) {
+	t.Log("Testing single SecureString parameter is decrypted")
+	p := &AwsSsmClientStruct{Client: &fakeSsm{params: map[string]string{
+		"/app/prod/db_password": "s3cr3t",
+		"/app/prod/db":          `{"host":"db.example.com","port":5432}`,
+	}}}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "db_password", VaultPath: "/app/prod/", EnvVar: "DB_PASSWORD", Origin: AwsSsmVarName},
+		{Name: "db", VaultPath: "/app/prod/", Field: "host", EnvVar: "DB_HOST", Origin: AwsSsmVarName},
+		{Name: "missing", VaultPath: "/app/prod/", EnvVar: "MISSING", Origin: AwsSsmVarName},
+	}
+	if err := p.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Err != nil || secrets[0].Secret != "s3cr3t" {
+		t.Errorf("expected decrypted parameter, got %q (%v)", secrets[0].Secret, secrets[0].Err)
+	}
+	if secrets[1].Err != nil || secrets[1].Secret != "db.example.com" {
+		t.Errorf("expected field of the parameter, got %q (%v)", secrets[1].Secret, secrets[1].Err)
+	}
+	if secrets[2].Err == nil {
+		t.Errorf("missing parameter should fail")
+	}
+}
+
+func TestAwsSsmFetchPathRejectsField(t *testing.T) {
+	t.Log("Testing field can't be selected in path mode")
+	p := &AwsSsmClientStruct{Client: &fakeSsm{params: map[string]string{"/app/prod/db_password": "s3cr3t"}}}
+	s := &secretschain.SecretStruct{Name: "", VaultPath: "/app/prod/", Field: "db_password", EnvVar: "APP_CONFIG", Origin: AwsSsmVarName}
+	if err := p.Fetch([]*secretschain.SecretStruct{s}); err != nil || s.Err == nil {
+		t.Errorf("expected field in path mode to fail, got %v %v", err, s.Err)
+	}
+}
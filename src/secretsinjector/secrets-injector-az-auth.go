@@ -0,0 +1,174 @@
+// Package provides authentication with Azure AD for AZ KeyVault
+//
+// The method is selected explicitly with AZURE_AUTH_METHOD: "environment" (default) sniffs the
+// environment with kvauth.NewAuthorizerFromEnvironment (client secret, certificate, MSI/aad-pod-identity),
+// "workloadidentity" exchanges the projected service-account token of Azure Workload Identity for an AAD token.
+//
+
+package secretsinjector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	kvauth "github.com/Azure/azure-sdk-for-go/services/keyvault/auth"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	log "github.com/sirupsen/logrus"
+
+	"utils"
+)
+
+// Constants
+const (
+	AzureAuthMethodName           = "AZURE_AUTH_METHOD"
+	AzureAuthEnvironment          = "environment"
+	AzureAuthWorkloadIdentity     = "workloadidentity"
+	AzureFederatedTokenFileName   = "AZURE_FEDERATED_TOKEN_FILE"
+	AzureClientIDName             = "AZURE_CLIENT_ID"
+	AzureTenantIDName             = "AZURE_TENANT_ID"
+	AzureAuthorityHostName        = "AZURE_AUTHORITY_HOST"
+	AzureEnvironmentName          = "AZURE_ENVIRONMENT"         // cloud of KeyVault, e.g. AzureUSGovernmentCloud, default AzurePublicCloud
+	AzureKeyVaultDNSSuffixName    = "AZURE_KEYVAULT_DNS_SUFFIX" // overrides DNS suffix of the cloud, e.g. vault.azure.cn
+	defaultAzureAuthorityHost     = "https://login.microsoftonline.com/"
+	azureKeyVaultScopeFmt         = "https://%s/.default"
+	azureTokenRefreshBeforeExpiry = 5 * time.Minute
+)
+
+// returns authorizer for AZ KeyVault, according to AZURE_AUTH_METHOD
+func newAzureAuthorizer() (autorest.Authorizer, error) {
+	switch method := strings.ToLower(utils.GetEnvVariableByName(AzureAuthMethodName)); method {
+	case "", AzureAuthEnvironment:
+		return kvauth.NewAuthorizerFromEnvironment()
+	case AzureAuthWorkloadIdentity, "workload-identity":
+		w, err := NewWorkloadIdentityAuthorizer()
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	default:
+		return nil, fmt.Errorf("unknown %s %s, expected %s or %s", AzureAuthMethodName, method, AzureAuthEnvironment, AzureAuthWorkloadIdentity)
+	}
+}
+
+// returns DNS suffix of KeyVaults: AZURE_KEYVAULT_DNS_SUFFIX, or suffix of the cloud given by AZURE_ENVIRONMENT,
+// which is also used by the environment authorizer
+func azureKeyVaultDNSSuffix() (string, error) {
+	if s := utils.GetEnvVariableByName(AzureKeyVaultDNSSuffixName); s != "" {
+		return strings.Trim(s, "."), nil
+	}
+	name := utils.GetEnvVariableByName(AzureEnvironmentName)
+	if name == "" {
+		return azure.PublicCloud.KeyVaultDNSSuffix, nil
+	}
+	env, err := azure.EnvironmentFromName(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", AzureEnvironmentName, err)
+	}
+	return env.KeyVaultDNSSuffix, nil
+}
+
+// WorkloadIdentityAuthorizer authorizes requests with AAD token obtained for the federated token of the pod.
+// The token file is re-read on every exchange, as kubelet rotates it
+type WorkloadIdentityAuthorizer struct {
+	TokenFile     string
+	ClientID      string
+	TenantID      string
+	AuthorityHost string
+	Scope         string
+	HTTPClient    *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresOn   time.Time
+}
+
+// NewWorkloadIdentityAuthorizer returns authorizer configured by the Azure Workload Identity webhook env variables
+func NewWorkloadIdentityAuthorizer() (*WorkloadIdentityAuthorizer, error) {
+	w := &WorkloadIdentityAuthorizer{
+		TokenFile:     utils.GetEnvVariableByName(AzureFederatedTokenFileName),
+		ClientID:      utils.GetEnvVariableByName(AzureClientIDName),
+		TenantID:      utils.GetEnvVariableByName(AzureTenantIDName),
+		AuthorityHost: utils.GetEnvVariableByName(AzureAuthorityHostName),
+		HTTPClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+	suffix, err := azureKeyVaultDNSSuffix()
+	if err != nil {
+		return nil, err
+	}
+	w.Scope = fmt.Sprintf(azureKeyVaultScopeFmt, suffix)
+	if w.AuthorityHost == "" {
+		w.AuthorityHost = defaultAzureAuthorityHost
+	}
+	if w.TokenFile == "" || w.ClientID == "" || w.TenantID == "" {
+		return nil, fmt.Errorf("workload identity requires %s, %s and %s, is the pod labeled azure.workload.identity/use=true?",
+			AzureFederatedTokenFileName, AzureClientIDName, AzureTenantIDName)
+	}
+	return w, nil
+}
+
+// WithAuthorization returns PrepareDecorator which adds bearer token, refreshed before it expires
+func (w *WorkloadIdentityAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			token, err := w.Token()
+			if err != nil {
+				return r, err
+			}
+			return autorest.Prepare(r, autorest.WithBearerAuthorization(token))
+		})
+	}
+}
+
+// Token returns valid AAD access token, exchanging the federated token when needed
+func (w *WorkloadIdentityAuthorizer) Token() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.accessToken != "" && time.Now().Add(azureTokenRefreshBeforeExpiry).Before(w.expiresOn) {
+		return w.accessToken, nil
+	}
+
+	assertion, err := ioutil.ReadFile(w.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read federated token: %v", err)
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {w.ClientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {w.Scope},
+	}
+	endpoint := strings.TrimSuffix(w.AuthorityHost, "/") + "/" + w.TenantID + "/oauth2/v2.0/token"
+	resp, err := w.HTTPClient.PostForm(endpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("unable to exchange federated token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("unable to decode token response (%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || r.AccessToken == "" {
+		return "", fmt.Errorf("unable to exchange federated token: %s %s %s", resp.Status, r.Error, r.ErrorDescription)
+	}
+	w.accessToken, w.expiresOn = r.AccessToken, time.Now().Add(time.Duration(r.ExpiresIn)*time.Second)
+	log.Debugf("obtained AAD token for client %s with workload identity, expires %s", w.ClientID, w.expiresOn)
+	return w.accessToken, nil
+}
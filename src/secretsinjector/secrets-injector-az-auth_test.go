@@ -0,0 +1,55 @@
+package secretsinjector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkloadIdentityToken(t *testing.T) {
+	t.Log("Testing exchange of federated token with Azure AD stub")
+	dir, err := ioutil.TempDir("", "workload-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "azure-identity-token")
+	_ = ioutil.WriteFile(tokenFile, []byte("federated-1\n"), 0600)
+
+	exchanges := 0
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.Form.Get("client_id") != "client" || r.Form.Get("scope") != "https://vault.azure.net/.default" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request","error_description":"unexpected request"}`)
+			return
+		}
+		exchanges++
+		// expires within the refresh window, so every call exchanges again
+		fmt.Fprintf(w, `{"access_token":"aad-%s","expires_in":60}`, r.Form.Get("client_assertion"))
+	}))
+	defer stub.Close()
+
+	w := &WorkloadIdentityAuthorizer{TokenFile: tokenFile, ClientID: "client", TenantID: "tenant",
+		AuthorityHost: stub.URL, Scope: "https://vault.azure.net/.default", HTTPClient: stub.Client()}
+	if token, err := w.Token(); err != nil || token != "aad-federated-1" {
+		t.Fatalf("unexpected token: %q %v", token, err)
+	}
+	_ = ioutil.WriteFile(tokenFile, []byte("federated-2"), 0600) // rotated by kubelet
+	if token, err := w.Token(); err != nil || token != "aad-federated-2" {
+		t.Errorf("rotated token file should be re-read, got %q %v", token, err)
+	}
+	if exchanges != 2 {
+		t.Errorf("expected 2 exchanges, got %d", exchanges)
+	}
+
+	w.TenantID = "other"
+	w.accessToken = ""
+	if _, err := w.Token(); err == nil {
+		t.Errorf("rejected exchange should fail")
+	}
+}
@@ -0,0 +1,121 @@
+// Package provides capabilities to retrieve certificates and public keys from AZ KeyVault
+//
+// Certificates are read through their backing secret (PFX or PEM) and split into tls.key, tls.crt and ca.crt,
+// keys are exported as public JWK.
+//
+
+package secretsinjector
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pkcs12"
+
+	"secretschain"
+)
+
+// Constants
+const (
+	OptionType       = "type" // secret (default), certificate or key
+	TypeCertificate  = "certificate"
+	TypeKey          = "key"
+	contentTypePFX   = "application/x-pkcs12"
+	contentTypePEM   = "application/x-pem-file"
+	azureVaultURLFmt = "https://%s.%s" // vault name, DNS suffix
+)
+
+// fetchCertificate retrieves certificate with its private key from the backing secret
+func (v *AzKeyVaultClientStruct) fetchCertificate(s *secretschain.SecretStruct) error {
+	log.Debugf("Making a call to:  %s to retrieve CERTIFICATE: %s\n", v.vaultURL(), s.Name)
+	resp, err := v.VaultClient.GetSecret(context.Background(), v.vaultURL(), s.Name, s.Options[OptionVersionID])
+	if err != nil {
+		return err
+	}
+	if resp.Value == nil {
+		return fmt.Errorf("certificate %s has no value", s.Name)
+	}
+	contentType := ""
+	if resp.ContentType != nil {
+		contentType = *resp.ContentType
+	}
+	values, err := splitCertificate(*resp.Value, contentType)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %v", s.Name, err)
+	}
+	return setTLSValues(s, values)
+}
+
+// fetchKey retrieves public part of the key as JWK
+func (v *AzKeyVaultClientStruct) fetchKey(s *secretschain.SecretStruct) error {
+	log.Debugf("Making a call to:  %s to retrieve KEY: %s\n", v.vaultURL(), s.Name)
+	resp, err := v.VaultClient.GetKey(context.Background(), v.vaultURL(), s.Name, s.Options[OptionVersionID])
+	if err != nil {
+		return err
+	}
+	if resp.Key == nil {
+		return fmt.Errorf("key %s has no value", s.Name)
+	}
+	j, err := json.Marshal(resp.Key) // KeyVault never returns private parts of the key
+	if err != nil {
+		return err
+	}
+	s.ContentType = "application/json"
+	return s.SetSecret(string(j))
+}
+
+// splitCertificate splits base64 PFX or PEM bundle into private key, leaf certificate and chain
+func splitCertificate(value, contentType string) (map[string]string, error) {
+	var blocks []*pem.Block
+	switch contentType {
+	case contentTypePFX:
+		pfx, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode PFX: %v", err)
+		}
+		if blocks, err = pkcs12.ToPEM(pfx, ""); err != nil { // KeyVault exports PFX without password
+			return nil, fmt.Errorf("unable to decode PFX: %v", err)
+		}
+	case contentTypePEM, "":
+		rest := []byte(value)
+		for {
+			var b *pem.Block
+			if b, rest = pem.Decode(rest); b == nil {
+				break
+			}
+			blocks = append(blocks, b)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %s", contentType)
+	}
+
+	var key, leaf string
+	chain := []string{}
+	for _, b := range blocks {
+		encoded := string(pem.EncodeToMemory(&pem.Block{Type: b.Type, Bytes: b.Bytes})) // PFX blocks carry attributes as headers
+		switch {
+		case strings.HasSuffix(b.Type, "PRIVATE KEY"):
+			key = encoded
+		case b.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate: %v", err)
+			}
+			if leaf == "" && !cert.IsCA {
+				leaf = encoded
+			} else {
+				chain = append(chain, encoded)
+			}
+		}
+	}
+	if key == "" || leaf == "" {
+		return nil, fmt.Errorf("no private key or leaf certificate found, is the key exportable?")
+	}
+	return map[string]string{TLSKeyKey: key, TLSCertKey: leaf, CACertKey: strings.Join(chain, "")}, nil
+}
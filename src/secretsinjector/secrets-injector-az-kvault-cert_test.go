@@ -0,0 +1,139 @@
+package secretsinjector
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/keyvault/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+
+	"secretschain"
+)
+
+// returns PEM of certificate signed by parent (self-signed if parent is nil) and its key
+func testCertificate(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestSplitCertificate(t *testing.T) {
+	t.Log("Testing split of KeyVault PEM certificate into key, leaf and chain")
+	ca, caKey, caPEM := testCertificate(t, "ca", true, nil, nil)
+	_, key, leafPEM := testCertificate(t, "web", false, ca, caKey)
+	der, _ := x509.MarshalECPrivateKey(key)
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	// KeyVault puts the key first, chain order is not guaranteed
+	values, err := splitCertificate(keyPEM+caPEM+leafPEM, contentTypePEM)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values[TLSKeyKey] != keyPEM || values[TLSCertKey] != leafPEM || values[CACertKey] != caPEM {
+		t.Errorf("unexpected split: %v", values)
+	}
+	if _, err := splitCertificate(caPEM+leafPEM, contentTypePEM); err == nil || !strings.Contains(err.Error(), "private key") {
+		t.Errorf("certificate without key should fail, got %v", err)
+	}
+	if _, err := splitCertificate("not base64", contentTypePFX); err == nil {
+		t.Errorf("invalid PFX should fail")
+	}
+}
+
+func TestAzKeyVaultFetchKey(t *testing.T) {
+	t.Log("Testing export of AZ KeyVault key as public JWK, in sovereign cloud")
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/keys/signing/" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":"KeyNotFound","message":"key not found"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"key":{"kid":"https://test-vault.vault.azure.cn/keys/signing/v1","kty":"RSA","key_ops":["verify"],"n":"0vx7","e":"AQAB"}}`))
+	}))
+	defer stub.Close()
+	endpoint, _ := url.Parse(stub.URL)
+
+	v := &AzKeyVaultClientStruct{VaultName: "test-vault", DNSSuffix: "vault.azure.cn", VaultClient: keyvault.New()}
+	v.VaultClient.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host != "test-vault.vault.azure.cn" {
+			t.Errorf("unexpected vault %s", r.URL.Host)
+		}
+		r.URL.Scheme, r.URL.Host = endpoint.Scheme, endpoint.Host
+		return http.DefaultClient.Do(r)
+	})
+	secrets := []*secretschain.SecretStruct{
+		{Name: "signing", Options: map[string]string{OptionType: TypeKey}},
+		{Name: "missing", Options: map[string]string{OptionType: TypeKey}},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	jwk := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(secrets[0].Secret), &jwk); err != nil || secrets[0].Err != nil {
+		t.Fatalf("expected JWK, got %q (%v %v)", secrets[0].Secret, err, secrets[0].Err)
+	}
+	if jwk["kty"] != "RSA" || jwk["n"] != "0vx7" || jwk["e"] != "AQAB" || secrets[0].ContentType != "application/json" {
+		t.Errorf("unexpected JWK %v (%s)", jwk, secrets[0].ContentType)
+	}
+	if secrets[1].Err == nil {
+		t.Errorf("missing key should fail")
+	}
+}
+
+func TestAzureKeyVaultDNSSuffix(t *testing.T) {
+	t.Log("Testing DNS suffix of KeyVaults follows the cloud")
+	cases := []struct {
+		environment, suffix, expected string
+	}{
+		{"", "", "vault.azure.net"},
+		{"AzureUSGovernmentCloud", "", "vault.usgovcloudapi.net"},
+		{"AzureChinaCloud", "", "vault.azure.cn"},
+		{"AzureChinaCloud", "vault.example.com", "vault.example.com"},
+	}
+	defer os.Unsetenv(AzureEnvironmentName)
+	defer os.Unsetenv(AzureKeyVaultDNSSuffixName)
+	for _, c := range cases {
+		os.Setenv(AzureEnvironmentName, c.environment)
+		os.Setenv(AzureKeyVaultDNSSuffixName, c.suffix)
+		if suffix, err := azureKeyVaultDNSSuffix(); err != nil || suffix != c.expected {
+			t.Errorf("%s %s: expected %s, got %s (%v)", c.environment, c.suffix, c.expected, suffix, err)
+		}
+	}
+	os.Setenv(AzureEnvironmentName, "AzureMoonCloud")
+	os.Setenv(AzureKeyVaultDNSSuffixName, "")
+	if _, err := azureKeyVaultDNSSuffix(); err == nil {
+		t.Errorf("unknown cloud should fail")
+	}
+}
@@ -0,0 +1,94 @@
+// Package provides capabilities to decrypt ciphertexts with AZ KeyVault keys
+//
+// Ciphertexts (base64url) are committed with the manifests, e.g. DB_PASS=<ciphertext>@azurekeyvault-key?key=app,
+// and decrypted at startup with the decrypt or unwrapKey operation of the key.
+//
+
+package secretsinjector
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/keyvault/keyvault"
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+)
+
+// Constants
+const (
+	AzureKeyVaultKeyVarName = "azurekeyvault-key"
+	OptionAlgorithm         = "alg" // RSA-OAEP-256 (default), RSA-OAEP or RSA1_5
+	OptionOperation         = "op"  // decrypt (default) or unwrap
+	defaultKeyAlgorithm     = keyvault.RSAOAEP256
+)
+
+// Az KeyVault key struct, shares client and authentication with AZ KeyVault secrets
+type AzKeyVaultKeyClientStruct struct {
+	AzKeyVaultClientStruct
+}
+
+func init() {
+	secretschain.RegisterProvider(AzureKeyVaultKeyVarName, func() secretschain.Provider { return &AzKeyVaultKeyClientStruct{} })
+}
+
+// Name of the origin
+func (v *AzKeyVaultKeyClientStruct) Name() string {
+	return AzureKeyVaultKeyVarName
+}
+
+// Fetch decrypts ciphertexts with the key given by ?key=, version of the key is selected with ?version=
+func (v *AzKeyVaultKeyClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		plaintext, err := v.decrypt(s)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		if err := s.SetSecret(plaintext); err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// decrypts ciphertext of the secret
+func (v *AzKeyVaultKeyClientStruct) decrypt(s *secretschain.SecretStruct) (string, error) {
+	key := s.Options[OptionKey]
+	if key == "" {
+		return "", fmt.Errorf("no key given, set ?%s=", OptionKey)
+	}
+	alg := keyvault.JSONWebKeyEncryptionAlgorithm(s.Options[OptionAlgorithm])
+	if alg == "" {
+		alg = defaultKeyAlgorithm
+	}
+	value := strings.TrimRight(ciphertext(s), "=") // API expects unpadded base64url
+	params := keyvault.KeyOperationsParameters{Algorithm: alg, Value: &value}
+	vaultURL := v.vaultURL()
+
+	log.Debugf("Making a call to:  %s to decrypt with KEY: %s\n", vaultURL, key)
+	var result keyvault.KeyOperationResult
+	var err error
+	switch op := strings.ToLower(s.Options[OptionOperation]); op {
+	case "", "decrypt":
+		result, err = v.VaultClient.Decrypt(context.Background(), vaultURL, key, s.Options[OptionVersionID], params)
+	case "unwrap", "unwrapkey":
+		result, err = v.VaultClient.UnwrapKey(context.Background(), vaultURL, key, s.Options[OptionVersionID], params)
+	default:
+		return "", fmt.Errorf("unknown operation %s, expected decrypt or unwrap", op)
+	}
+	if err != nil {
+		return "", err
+	}
+	if result.Result == nil {
+		return "", fmt.Errorf("empty result of key %s", key)
+	}
+	plaintext, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*result.Result, "="))
+	if err != nil {
+		return "", fmt.Errorf("unable to decode plaintext: %v", err)
+	}
+	return string(plaintext), nil
+}
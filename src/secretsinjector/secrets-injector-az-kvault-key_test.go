@@ -0,0 +1,89 @@
+package secretsinjector
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/keyvault/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+
+	"secretschain"
+)
+
+// stubs decrypt and unwrapkey operations of key app, "decrypting" ciphertext by base64url decoding it
+func newKeyOperationsStub(t *testing.T, requests map[string]keyvault.KeyOperationsParameters) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params keyvault.KeyOperationsParameters
+		_ = json.NewDecoder(r.Body).Decode(&params)
+		requests[r.URL.Path] = params
+		if !strings.HasPrefix(r.URL.Path, "/keys/app/") || params.Value == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":"KeyNotFound","message":"key not found"}}`))
+			return
+		}
+		plaintext, err := base64.RawURLEncoding.DecodeString(*params.Value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"code":"BadParameter","message":"invalid ciphertext"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"kid": "https://test-vault.vault.azure.net/keys/app/v1",
+			"value": base64.RawURLEncoding.EncodeToString(plaintext)})
+	}))
+}
+
+func TestAzKeyVaultKeyFetch(t *testing.T) {
+	t.Log("Testing decryption with AZ KeyVault keys against local stub")
+	requests := map[string]keyvault.KeyOperationsParameters{}
+	stub := newKeyOperationsStub(t, requests)
+	defer stub.Close()
+	endpoint, _ := url.Parse(stub.URL)
+
+	v := &AzKeyVaultKeyClientStruct{}
+	v.VaultName = "test-vault"
+	v.VaultClient = keyvault.New()
+	v.VaultClient.Sender = autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host != "test-vault.vault.azure.net" {
+			t.Errorf("unexpected vault %s", r.URL.Host)
+		}
+		r.URL.Scheme, r.URL.Host = endpoint.Scheme, endpoint.Host
+		return http.DefaultClient.Do(r)
+	})
+
+	b64 := func(s string) string { return base64.URLEncoding.EncodeToString([]byte(s)) } // padded, as often committed
+	secrets := []*secretschain.SecretStruct{
+		{Name: b64("s3cr3t"), Options: map[string]string{OptionKey: "app"}},
+		{Name: b64("data-key"), Options: map[string]string{OptionKey: "app", OptionOperation: "unwrap", OptionAlgorithm: "RSA-OAEP", OptionVersionID: "v1"}},
+		{Name: b64("x"), Options: map[string]string{OptionKey: "other"}},
+		{Name: b64("x"), Options: map[string]string{OptionKey: "app", OptionOperation: "sign"}},
+		{Name: b64("x")},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "s3cr3t" || secrets[1].Secret != "data-key" {
+		t.Errorf("unexpected values: %q (%v), %q (%v)", secrets[0].Secret, secrets[0].Err, secrets[1].Secret, secrets[1].Err)
+	}
+	for _, s := range secrets[2:] {
+		if s.Err == nil {
+			t.Errorf("secret with options %v should fail", s.Options)
+		}
+	}
+
+	decrypt, ok := requests["/keys/app//decrypt"]
+	if !ok || decrypt.Algorithm != keyvault.RSAOAEP256 || *decrypt.Value != strings.TrimRight(b64("s3cr3t"), "=") {
+		t.Errorf("unexpected decrypt request %+v", requests)
+	}
+	if unwrap, ok := requests["/keys/app/v1/unwrapkey"]; !ok || unwrap.Algorithm != keyvault.RSAOAEP {
+		t.Errorf("unexpected unwrapkey request %+v", requests)
+	}
+	if len(requests) != 3 {
+		t.Errorf("invalid options should fail without request, got %d requests", len(requests))
+	}
+}
@@ -5,15 +5,15 @@ package secretsinjector
 import (
 	_ "encoding/json"
 	"fmt"
-	_ "strings"
+	"strings"
 	"errors"
 	_ "os"
 	"context"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/Azure/azure-sdk-for-go/profiles/latest/keyvault/keyvault"
-	kvauth "github.com/Azure/azure-sdk-for-go/services/keyvault/auth"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 
 	"utils"
 	"secretschain"
@@ -23,17 +23,17 @@ import (
 type AzKeyVaultClientStruct struct {
 	Authorizer 			autorest.Authorizer
 	VaultClient			keyvault.BaseClient
+	VaultName			string
+	DNSSuffix			string // of the cloud, vault.azure.net if empty
 	Chain 				*secretschain.SecretChainStruct
 }
 
+func init() {
+	secretschain.RegisterProvider(secretschain.AzureVaultVarName, func() secretschain.Provider { return &AzKeyVaultClientStruct{} })
+}
+
 // Create new HC vault client and populate the environment in it
 func NewAzKVault(ch *secretschain.SecretChainStruct) (*AzKeyVaultClientStruct, error) {
-	// i do wonder what is the name of the vault that i suppose to interact with, eh?
-	nameKV := utils.GetEnvVariableByName( secretschain.AzureVaultVarName)
-	if nameKV == "" { // dude! really?? check your vars..
-		return nil, errors.New( fmt.Sprintf("Can't create new instancce of Azure KVault Client - the name of KVault can not be empty.") )
-	}
-
 	var err error
 	v := &AzKeyVaultClientStruct{}
 	if ch == nil {
@@ -41,34 +41,103 @@ func NewAzKVault(ch *secretschain.SecretChainStruct) (*AzKeyVaultClientStruct, e
 	}else{
 		v.Chain = ch
 	}
+	if err = v.Init(); err != nil {
+		return nil, err
+	}
+	return v, v.Fetch( secretsOf(v.Chain, v.Name()) )
+}
+
+// Name of the origin
+func (v *AzKeyVaultClientStruct) Name() string {
+	return secretschain.AzureVaultVarName
+}
+
+// Init creates KeyVault client
+func (v *AzKeyVaultClientStruct) Init() error {
+	// i do wonder what is the name of the vault that i suppose to interact with, eh?
+	v.VaultName = utils.GetEnvVariableByName( secretschain.AzureVaultVarName)
+	if v.VaultName == "" { // dude! really?? check your vars..
+		return errors.New( fmt.Sprintf("Can't create new instancce of Azure KVault Client - the name of KVault can not be empty.") )
+	}
 
-	v.Authorizer, err = kvauth.NewAuthorizerFromEnvironment()  // knock knock.. who's there?
+	var err error
+	if v.DNSSuffix, err = azureKeyVaultDNSSuffix(); err != nil { // AZURE_ENVIRONMENT or AZURE_KEYVAULT_DNS_SUFFIX
+		return err
+	}
+	v.Authorizer, err = newAzureAuthorizer()  // knock knock.. who's there? (AZURE_AUTH_METHOD)
 	if err != nil {
 		// sod off mate - don't know yah
-		return nil, errors.New( fmt.Sprintf("Can't initialize authorizer: %v", err.Error()) )
+		return errors.New( fmt.Sprintf("Can't initialize authorizer: %v", err.Error()) )
 	}
 
 	v.VaultClient = keyvault.New() // brand new! and shiny! keyVault Client! Hallelujah! Praise the Lord!
 	v.VaultClient.Authorizer = v.Authorizer
+	return nil
+}
 
-	for idx, _ := range v.Chain.Secrets { // loop through all the secrets we fished out from the env.
-		if v.Chain.Secrets[idx].Origin == secretschain.AzureVaultVarName { // filter out everything but Azure KeyVaul origins
-			// Huston, we have Take Off!
-			// here is where we're doing some damage and pulling secrets
-			secretResp, err := getSecret( v.VaultClient, nameKV, v.Chain.Secrets[idx].Name )  // let's take this baby out for a walk..
-			if err != nil {
-				log.Errorf("unable to generate secrets chain:  %v", err.Error()) // what the.
-			} else {
-				v.Chain.Secrets[idx].Secret = *secretResp.Value  // miracles are real!
+// Fetch secrets from KeyVault
+func (v *AzKeyVaultClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		switch strings.ToLower(s.Options[OptionType]) {
+		case TypeCertificate: // TLS material, split into files
+			if err := v.fetchCertificate(s); err != nil {
+				s.Fail(err)
+			}
+			continue
+		case TypeKey: // public JWK
+			if err := v.fetchKey(s); err != nil {
+				s.Fail(err)
 			}
+			continue
+		case "", "secret":
+		default:
+			s.Fail( fmt.Errorf("unknown type %s, expected secret, certificate or key", s.Options[OptionType]) )
+			continue
+		}
+		// Huston, we have Take Off!
+		// here is where we're doing some damage and pulling secrets
+		secretResp, err := getSecret( v.VaultClient, v.vaultURL(), s.Name, s.Options[OptionVersionID] )  // let's take this baby out for a walk..
+		if err != nil {
+			s.Fail(err) // what the.
+			continue
+		}
+		if secretResp.ContentType != nil {
+			s.ContentType = *secretResp.ContentType
+		}
+		if err := s.SetSecret( *secretResp.Value ); err != nil {  // miracles are real!
+			s.Fail(err)
 		}
 	}
-	return v, nil
+	return nil
+}
+
+// Close the provider
+func (v *AzKeyVaultClientStruct) Close() error {
+	return nil
+}
+
+// returns URL of the vault, e.g. https://myvault.vault.azure.net
+func (v *AzKeyVaultClientStruct) vaultURL() string {
+	suffix := v.DNSSuffix
+	if suffix == "" {
+		suffix = azure.PublicCloud.KeyVaultDNSSuffix
+	}
+	return fmt.Sprintf(azureVaultURLFmt, v.VaultName, suffix)
 }
 
 // Low level function to get the secret from Azure KeyVault based on its name
-func getSecret(vaultClient keyvault.BaseClient, vaultname string, secname string) (result keyvault.SecretBundle, err error) {
-	log.Debugf("Making a call to:  https://%s.vault.azure.net to retrieve value for KEY: %s\n", vaultname, secname)
-	return vaultClient.GetSecret(context.Background(), "https://"+vaultname+".vault.azure.net", secname, "")
+func getSecret(vaultClient keyvault.BaseClient, vaultURL string, secname string, version string) (result keyvault.SecretBundle, err error) {
+	log.Debugf("Making a call to:  %s to retrieve value for KEY: %s\n", vaultURL, secname)
+	return vaultClient.GetSecret(context.Background(), vaultURL, secname, version)
 }
 
+// returns secrets of the chain with given origin
+func secretsOf(ch *secretschain.SecretChainStruct, origin string) []*secretschain.SecretStruct {
+	secrets := []*secretschain.SecretStruct{}
+	for idx, _ := range ch.Secrets { // loop through all the secrets we fished out from the env.
+		if ch.Secrets[idx].Origin == origin {
+			secrets = append(secrets, &ch.Secrets[idx])
+		}
+	}
+	return secrets
+}
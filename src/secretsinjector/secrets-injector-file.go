@@ -0,0 +1,205 @@
+// Package provides capabilities to retrieve secrets from local JSON, YAML or dotenv file
+//
+// Meant for developer laptops and CI: with the offline switch every Hashicorp Vault and
+// Azure KeyVault reference is resolved from the local file, so the same pod env works everywhere.
+//
+
+package secretsinjector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"sigs.k8s.io/yaml"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	FileVarName      = "file"
+	DotenvVarName    = "dotenv"
+	LocalFileVarName = "SECRET_INJECTOR_LOCAL_FILE" // path of the local secrets file
+	OfflineVarName   = "SECRET_INJECTOR_OFFLINE"    // if true, vault references are resolved from the local file
+	OptionPath       = "path"                       // per-secret override of the local file, e.g. ?path=./secrets.yaml
+	defaultLocalFile = ".env"
+)
+
+// Local file struct
+type FileClientStruct struct {
+	Origin string
+	docs   map[string]string // path -> file content as JSON document
+}
+
+func init() {
+	secretschain.RegisterProvider(FileVarName, func() secretschain.Provider { return &FileClientStruct{Origin: FileVarName} })
+	secretschain.RegisterProvider(DotenvVarName, func() secretschain.Provider { return &FileClientStruct{Origin: DotenvVarName} })
+}
+
+// ConfigureOffline redirects Hashicorp Vault and Azure KeyVault references to the local file, if offline is true
+func ConfigureOffline(offline bool) {
+	if !offline {
+		return
+	}
+	log.Warningf("offline mode: vault references are resolved from local file %s", localFile())
+	secretschain.RedirectOrigin(secretschain.HcVaultVarName, FileVarName)
+	secretschain.RedirectOrigin(secretschain.AzureVaultVarName, FileVarName)
+}
+
+// IsOffline reports whether offline switch is set in the environment
+func IsOffline() bool {
+	b, _ := strconv.ParseBool(utils.GetEnvVariableByName(OfflineVarName))
+	return b
+}
+
+// Name of the origin
+func (v *FileClientStruct) Name() string {
+	return v.Origin
+}
+
+// Init the provider, files are read on first use
+func (v *FileClientStruct) Init() error {
+	v.docs = make(map[string]string)
+	return nil
+}
+
+// Fetch secrets from the local file. Reference is looked up as top-level key first
+// (e.g. secret/shared/db/mysql), then as gjson path (e.g. path.to.key) and finally by its name only
+func (v *FileClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		p := localFile()
+		if o := s.Options[OptionPath]; o != "" {
+			p = o
+		}
+		doc, err := v.load(p)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+
+		if err := lookupDocument(doc, s, p); err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Close the provider
+func (v *FileClientStruct) Close() error {
+	return nil
+}
+
+// lookupDocument sets the secret from JSON document doc, read from src. Reference is looked up as top-level key first,
+// then as gjson path. Secret of other path is never used, so references with path must match it in full
+func lookupDocument(doc string, s *secretschain.SecretStruct, src string) error {
+	full := s.VaultPath + s.Name
+	var r gjson.Result
+	for _, key := range []string{escapeGjson(full), strings.Replace(strings.Trim(full, "/"), "/", ".", -1)} {
+		if r = gjson.Get(doc, key); r.Exists() {
+			break
+		}
+	}
+	if !r.Exists() {
+		return fmt.Errorf("secret %s not found in %s", full, src)
+	}
+	value := r.Raw
+	if r.Type == gjson.String {
+		value = r.Str
+	} else if r.IsObject() {
+		s.ContentType = "application/json"
+	}
+	return s.SetSecret(value)
+}
+
+// loads file p as JSON document. Format follows the origin (dotenv) or extension of the file
+func (v *FileClientStruct) load(p string) (string, error) {
+	if doc, ok := v.docs[p]; ok {
+		return doc, nil
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("unable to read local secrets file: %v", err)
+	}
+
+	var j []byte
+	ext := strings.ToLower(filepath.Ext(p))
+	switch {
+	case v.Origin == DotenvVarName || ext == ".env":
+		var m map[string]string
+		if m, err = ParseDotenv(b); err == nil {
+			j, err = json.Marshal(m)
+		}
+	case ext == ".json":
+		j = b
+	default: // YAML, which is superset of JSON
+		j, err = yaml.YAMLToJSON(b)
+	}
+	if err == nil && !gjson.ValidBytes(j) {
+		err = fmt.Errorf("not a valid document")
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to parse local secrets file %s: %v", p, err)
+	}
+	log.Debugf("loaded local secrets file %s", p)
+	v.docs[p] = string(j)
+	return v.docs[p], nil
+}
+
+// ParseDotenv parses dotenv file: KEY=VALUE lines, optionally prefixed with "export",
+// values may be single quoted (literal) or double quoted (with \n, \t, \" and \\ escapes); # starts a comment
+func ParseDotenv(b []byte) (map[string]string, error) {
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			value = unquoted
+		default:
+			if idx := strings.Index(value, " #"); idx >= 0 {
+				value = strings.TrimSpace(value[:idx])
+			}
+		}
+		m[key] = value
+	}
+	return m, scanner.Err()
+}
+
+// returns path of the local secrets file
+func localFile() string {
+	if p := utils.GetEnvVariableByName(LocalFileVarName); p != "" {
+		return p
+	}
+	return defaultLocalFile
+}
+
+// escapes gjson special characters, so s is matched as a single key
+func escapeGjson(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ".", `\.`, "*", `\*`, "?", `\?`, "|", `\|`, "#", `\#`, "@", `\@`)
+	return r.Replace(s)
+}
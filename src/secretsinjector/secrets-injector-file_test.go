@@ -0,0 +1,61 @@
+package secretsinjector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"secretschain"
+)
+
+func TestParseDotenv(t *testing.T) {
+	t.Log("Testing dotenv parser")
+	m, err := ParseDotenv([]byte("# comment\nexport A=1\nB = 'x # y'\nC=\"line\\nbreak\"\nD=plain # trailing\n\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"A": "1", "B": "x # y", "C": "line\nbreak", "D": "plain"}
+	for k, v := range expected {
+		if m[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, m[k])
+		}
+	}
+	if _, err := ParseDotenv([]byte("NOT_A_PAIR")); err == nil {
+		t.Errorf("invalid line should fail")
+	}
+}
+
+func TestFileFetch(t *testing.T) {
+	t.Log("Testing local file provider with YAML file")
+	dir, err := ioutil.TempDir("", "secret-injector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "secrets.yaml")
+	yml := "secret/shared/db/mysql:\n  username: appuser\n  password: local-only\nnested:\n  key: value\ntoken: abc\n"
+	if err := ioutil.WriteFile(p, []byte(yml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &FileClientStruct{Origin: FileVarName}
+	_ = v.Init()
+	opts := map[string]string{OptionPath: p}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "mysql", VaultPath: "secret/shared/db/", Field: "password", Options: opts},
+		{Name: "key", VaultPath: "nested/", Options: opts},
+		{Name: "token", Options: opts},
+		{Name: "token", VaultPath: "secret/app/", Options: opts},
+		{Name: "missing", Options: opts},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "local-only" || secrets[1].Secret != "value" || secrets[2].Secret != "abc" {
+		t.Errorf("unexpected values: %q %q %q", secrets[0].Secret, secrets[1].Secret, secrets[2].Secret)
+	}
+	if secrets[3].Err == nil || secrets[4].Err == nil {
+		t.Errorf("%s should not be found by name only, missing secret should fail", secrets[3].VaultPath+secrets[3].Name)
+	}
+}
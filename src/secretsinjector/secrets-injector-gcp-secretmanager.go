@@ -0,0 +1,169 @@
+// Package provides capabilities to retrieve secrets from Google Cloud Secret Manager
+//
+
+package secretsinjector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	GcpSecretManagerVarName      = "gcpsecretmanager"
+	GcpSecretManagerEndpointName = "GCP_SECRETMANAGER_ENDPOINT" // endpoint override, e.g. for local stubs
+	GcpSecretManagerEndpoint     = "https://secretmanager.googleapis.com"
+	gcpScope                     = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// GCP Secret Manager struct
+type GcpSecretManagerClientStruct struct {
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+// response of versions.access
+type gcpAccessResponse struct {
+	Name    string `json:"name"`
+	Payload struct {
+		Data       string `json:"data"`
+		DataCrc32c string `json:"dataCrc32c"` // int64 as string, set if checksum is known
+	} `json:"payload"`
+}
+
+// error response of Google APIs
+type gcpErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+func init() {
+	secretschain.RegisterProvider(GcpSecretManagerVarName, func() secretschain.Provider { return &GcpSecretManagerClientStruct{} })
+}
+
+// Name of the origin
+func (v *GcpSecretManagerClientStruct) Name() string {
+	return GcpSecretManagerVarName
+}
+
+// Init creates authenticated HTTP client. Application Default Credentials are used:
+// service-account JSON key file from GOOGLE_APPLICATION_CREDENTIALS or GKE Workload Identity through metadata server
+func (v *GcpSecretManagerClientStruct) Init() error {
+	if v.Endpoint == "" {
+		v.Endpoint = GcpSecretManagerEndpoint
+		if ep := utils.GetEnvVariableByName(GcpSecretManagerEndpointName); ep != "" {
+			v.Endpoint = ep
+		}
+	}
+	v.Endpoint = strings.TrimSuffix(v.Endpoint, "/")
+	if v.HTTPClient != nil {
+		return nil // already set, e.g. by tests
+	}
+	ctx := context.Background()
+	creds, err := google.FindDefaultCredentials(ctx, gcpScope)
+	if err != nil {
+		return fmt.Errorf("unable to find GCP credentials: %v", err)
+	}
+	v.HTTPClient = oauth2.NewClient(ctx, creds.TokenSource)
+	return nil
+}
+
+// Fetch secret versions, addressed as projects/<p>/secrets/<name>/versions/<v|latest>.
+// Version may be omitted, then latest is used. Files are named after the secret, e.g. <name>
+func (v *GcpSecretManagerClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		name := s.VaultPath + s.Name
+		if !strings.Contains(name, "/versions/") {
+			name += "/versions/latest"
+		}
+		if !strings.HasPrefix(name, "projects/") || strings.Count(name, "/") != 5 {
+			s.Fail(fmt.Errorf("invalid secret version name %s, expected projects/<project>/secrets/<name>/versions/<version>", name))
+			continue
+		}
+		if id := strings.Split(name, "/")[3]; s.FilePath != "" && s.File == s.Name && s.Name != id {
+			s.File = id // file is named after the secret, not its version
+		}
+		data, err := v.access(name)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		if err := s.SetSecret(string(data)); err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Close the provider
+func (v *GcpSecretManagerClientStruct) Close() error {
+	return nil
+}
+
+// accesses secret version and verifies payload checksum
+func (v *GcpSecretManagerClientStruct) access(name string) ([]byte, error) {
+	log.Debugf("retrieving secret %s from GCP Secret Manager", name)
+	resp, err := v.HTTPClient.Get(v.Endpoint + "/v1/" + name + ":access")
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve secret %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s: %v", name, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := gcpErrorResponse{}
+		_ = json.Unmarshal(body, &e)
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, fmt.Errorf("secret %s not found: %s", name, e.Error.Message)
+		case http.StatusForbidden, http.StatusUnauthorized:
+			return nil, fmt.Errorf("access to secret %s denied: %s", name, e.Error.Message)
+		case http.StatusBadRequest:
+			if e.Error.Status == "FAILED_PRECONDITION" { // e.g. disabled or destroyed version
+				return nil, fmt.Errorf("secret %s is not accessible: %s", name, e.Error.Message)
+			}
+		}
+		return nil, fmt.Errorf("unable to retrieve secret %s: %s %s", name, resp.Status, e.Error.Message)
+	}
+
+	r := gcpAccessResponse{}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unable to decode secret %s: %v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(r.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode payload of secret %s: %v", name, err)
+	}
+	if r.Payload.DataCrc32c != "" {
+		expected, err := strconv.ParseUint(r.Payload.DataCrc32c, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum of secret %s: %v", name, err)
+		}
+		if actual := crc32.Checksum(data, crc32cTable); uint32(expected) != actual {
+			return nil, fmt.Errorf("payload of secret %s is corrupted: crc32c %d, expected %d", name, actual, expected)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,64 @@
+package secretsinjector
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"secretschain"
+)
+
+func TestGcpSecretManagerFetch(t *testing.T) {
+	t.Log("Testing GCP Secret Manager provider against local stub")
+	payload := []byte(`{"username":"appuser","password":"s3cr3t"}`)
+	data := base64.StdEncoding.EncodeToString(payload)
+	crc := crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli))
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/projects/p1/secrets/db/versions/latest:access", "/v1/projects/p1/secrets/db/versions/3:access":
+			fmt.Fprintf(w, `{"name":"projects/123/secrets/db/versions/3","payload":{"data":"%s","dataCrc32c":"%d"}}`, data, crc)
+		case "/v1/projects/p1/secrets/corrupted/versions/latest:access":
+			fmt.Fprintf(w, `{"name":"projects/123/secrets/corrupted/versions/1","payload":{"data":"%s","dataCrc32c":"%d"}}`, data, crc+1)
+		case "/v1/projects/p1/secrets/denied/versions/latest:access":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":403,"message":"Permission 'secretmanager.versions.access' denied","status":"PERMISSION_DENIED"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Secret not found","status":"NOT_FOUND"}}`)
+		}
+	}))
+	defer stub.Close()
+
+	p := &GcpSecretManagerClientStruct{Endpoint: stub.URL, HTTPClient: stub.Client()}
+	if err := p.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "latest", VaultPath: "projects/p1/secrets/db/versions/", Field: "password", FilePath: "/etc/secrets/", File: "latest"},
+		{Name: "db", VaultPath: "projects/p1/secrets/"},
+		{Name: "3", VaultPath: "projects/p1/secrets/db/versions/", Field: "username"},
+		{Name: "corrupted", VaultPath: "projects/p1/secrets/"},
+		{Name: "denied", VaultPath: "projects/p1/secrets/"},
+		{Name: "missing", VaultPath: "projects/p1/secrets/"},
+		{Name: "db"},
+	}
+	if err := p.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "s3cr3t" || secrets[1].Secret != string(payload) || secrets[2].Secret != "appuser" {
+		t.Errorf("unexpected values: %q %q %q", secrets[0].Secret, secrets[1].Secret, secrets[2].Secret)
+	}
+	if secrets[0].File != "db" {
+		t.Errorf("file should be named after the secret, got %s", secrets[0].File)
+	}
+	for _, s := range secrets[3:] {
+		if s.Err == nil {
+			t.Errorf("secret %s%s should fail", s.VaultPath, s.Name)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package provides capabilities to issue TLS certificates from Hashicorp Vault PKI secrets engine
+//
+
+package secretsinjector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	OptionPKI      = "pki"       // secret is a certificate issued by pki/issue/<role>
+	OptionCN       = "cn"        // common name, template
+	OptionAltNames = "alt_names" // comma separated DNS SANs, template
+	OptionIPSans   = "ip_sans"   // comma separated IP SANs, template
+	OptionTTL      = "ttl"       // e.g. 24h, default is TTL of the role
+	OptionBundle   = "bundle"    // write certificate, chain and key as single PEM file
+	TLSCertKey     = "tls.crt"
+	TLSKeyKey      = "tls.key"
+	CACertKey      = "ca.crt"
+	TLSKeyMode     = 0400 // default mode of files holding private key, readable by the owner only
+)
+
+// PodMetadata is input of CN/SAN templates, e.g. cn={{.ServiceName}}.{{.Namespace}}.svc
+type PodMetadata struct {
+	PodName     string // POD_NAME
+	Namespace   string // POD_NAMESPACE or service-account mount
+	PodIP       string // POD_IP
+	ServiceName string // SERVICE_NAME
+}
+
+// returns metadata of the pod from env variables, usually set with downward API
+func podMetadata() PodMetadata {
+	return PodMetadata{
+		PodName:     utils.GetEnvVariableByName("POD_NAME"),
+		Namespace:   podNamespace(),
+		PodIP:       utils.GetEnvVariableByName("POD_IP"),
+		ServiceName: utils.GetEnvVariableByName("SERVICE_NAME"),
+	}
+}
+
+// renders template t with pod metadata
+func renderPodTemplate(t string, md PodMetadata) (string, error) {
+	if !strings.Contains(t, "{{") {
+		return t, nil
+	}
+	tmpl, err := template.New("pki").Option("missingkey=error").Parse(t)
+	if err != nil {
+		return "", fmt.Errorf("invalid template '%s': %v", t, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, md); err != nil {
+		return "", fmt.Errorf("unable to render template '%s': %v", t, err)
+	}
+	return b.String(), nil
+}
+
+// issueCertificate issues certificate with role pki/issue/<role>. The secret gets tls.crt, tls.key and ca.crt keys,
+// written one file per key for file secrets, or combined PEM with ?bundle. Files with the private key get mode 0400,
+// unless the secret has its own mode. Expiry of the certificate is tracked by Leases
+func (v *HCVaultClientStruct) issueCertificate(secret *secretschain.SecretStruct) error {
+	p := secretPath(secret)
+	if !strings.Contains(p, "/issue/") {
+		return fmt.Errorf("invalid PKI reference '%s', expected <mount>/issue/<role>", p)
+	}
+	md := podMetadata()
+	data := make(map[string]interface{})
+	for opt, param := range map[string]string{OptionCN: "common_name", OptionAltNames: "alt_names", OptionIPSans: "ip_sans", OptionTTL: "ttl"} {
+		value, ok := secret.Options[opt]
+		if !ok {
+			continue
+		}
+		rendered, err := renderPodTemplate(value, md)
+		if err != nil {
+			return err
+		}
+		data[param] = rendered
+	}
+	if data["common_name"] == nil || data["common_name"] == "" {
+		return fmt.Errorf("certificate '%s' has no common name, set ?%s=", p, OptionCN)
+	}
+
+	log.Debugf("issuing certificate %v with %s", data["common_name"], p)
+	c, err := v.Vault.NamespaceClient(secret.Options[OptionNamespace])
+	if err != nil {
+		return err
+	}
+	s, err := c.Logical().Write(p, data)
+	if err != nil {
+		return err
+	}
+	if s == nil || s.Data == nil {
+		return fmt.Errorf("no certificate issued by '%s'", p)
+	}
+	cert, _ := s.Data["certificate"].(string)
+	key, _ := s.Data["private_key"].(string)
+	ca, _ := s.Data["issuing_ca"].(string)
+	if cert == "" || key == "" {
+		return fmt.Errorf("response of '%s' has no certificate or private key", p)
+	}
+	chain := []string{}
+	if c, ok := s.Data["ca_chain"].([]interface{}); ok {
+		for _, pem := range c {
+			if pem, ok := pem.(string); ok {
+				chain = append(chain, pem)
+			}
+		}
+	}
+	if len(chain) == 0 && ca != "" {
+		chain = append(chain, ca)
+	}
+	log.Infof("issued certificate %v, serial %v, expires %v", data["common_name"], s.Data["serial_number"], s.Data["expiration"])
+	if n, ok := s.Data["expiration"].(json.Number); ok && v.Leases != nil {
+		exp, err := n.Int64()
+		if err != nil {
+			log.Warningf("invalid expiration %v of certificate %v, it is not issued again: %v", n, data["common_name"], err)
+		} else {
+			v.Leases.TrackExpiry(p, time.Until(time.Unix(exp, 0))) // sidecar issues it again before it expires
+		}
+	}
+
+	if _, ok := secret.Options[OptionBundle]; ok {
+		if secret.Mode == 0 {
+			secret.Mode = TLSKeyMode
+		}
+		pems := append(append([]string{cert}, chain...), key)
+		return secret.SetSecret(strings.Join(pems, "\n") + "\n")
+	}
+	return setTLSValues(secret, map[string]string{TLSCertKey: cert, TLSKeyKey: key, CACertKey: ca})
+}
+
+// setTLSValues sets TLS material as JSON object, file secrets get one file per key (tls.crt, tls.key, ca.crt)
+func setTLSValues(secret *secretschain.SecretStruct, values map[string]string) error {
+	j, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	secret.ContentType = "application/json"
+	if err := secret.SetSecret(string(j)); err != nil {
+		return err
+	}
+	if secret.Values == nil && secret.Field == "" && secret.FilePath != "" {
+		secret.Values = values // one file per key
+		if _, ok := values[TLSKeyKey]; ok && secret.Mode == 0 {
+			secret.Modes = map[string]os.FileMode{TLSKeyKey: TLSKeyMode}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package secretsinjector
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"secretschain"
+)
+
+func TestRenderPodTemplate(t *testing.T) {
+	t.Log("Testing CN/SAN templates with pod metadata")
+	md := PodMetadata{PodName: "web-0", Namespace: "shop", ServiceName: "web"}
+	cases := map[string]string{
+		"web.example.com":                         "web.example.com",
+		"{{.ServiceName}}.{{.Namespace}}.svc":     "web.shop.svc",
+		"{{.PodName}}.{{.ServiceName}},localhost": "web-0.web,localhost",
+	}
+	for in, expected := range cases {
+		out, err := renderPodTemplate(in, md)
+		if err != nil || out != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", in, expected, out, err)
+		}
+	}
+	if _, err := renderPodTemplate("{{.Unknown}}", md); err == nil {
+		t.Errorf("unknown field should fail")
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	t.Log("Testing certificates issued by PKI secrets engine stub")
+	f, v, cleanup := newVaultStub(t, map[string]string{
+		"PUT /v1/pki/issue/web": fmt.Sprintf(`{"data":{"certificate":"CERT","private_key":"KEY","issuing_ca":"CA","ca_chain":["CA","ROOT"],
+			"serial_number":"01:02","expiration":%d}}`, time.Now().Add(time.Hour).Unix()),
+	})
+	defer cleanup()
+
+	pki := func(opts ...string) map[string]string {
+		m := map[string]string{OptionPKI: "", OptionCN: "web.example.com", OptionTTL: "24h"}
+		for _, o := range opts {
+			m[o] = ""
+		}
+		return m
+	}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "web", VaultPath: "pki/issue/", FilePath: "/etc/tls/", Options: pki()},
+		{Name: "web", VaultPath: "pki/issue/", FilePath: "/etc/tls/", File: "web.pem", Options: pki(OptionBundle)},
+		{Name: "web", VaultPath: "pki/issue/", FilePath: "/etc/tls/", Mode: 0440, Options: pki()},
+		{Name: "web", VaultPath: "pki/issue/", EnvVar: "TLS_CERT", Field: `tls\.crt`, Options: pki()},
+		{Name: "web", VaultPath: "pki/issue/", FilePath: "/etc/tls/", Options: map[string]string{OptionPKI: ""}},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files := secrets[0]
+	if files.Err != nil || files.Values[TLSCertKey] != "CERT" || files.Values[TLSKeyKey] != "KEY" || files.Values[CACertKey] != "CA" {
+		t.Errorf("unexpected values %v (%v)", files.Values, files.Err)
+	}
+	if files.Modes[TLSKeyKey] != TLSKeyMode || files.Mode != 0 {
+		t.Errorf("only private key should default to mode %o, got %v", TLSKeyMode, files.Modes)
+	}
+	bundle := secrets[1]
+	if bundle.Secret != "CERT\nCA\nROOT\nKEY\n" || bundle.Values != nil || bundle.Mode != TLSKeyMode {
+		t.Errorf("unexpected bundle %q, mode %o (%v)", bundle.Secret, bundle.Mode, bundle.Err)
+	}
+	if secrets[2].Modes != nil {
+		t.Errorf("mode of the secret should apply to private key, got %v", secrets[2].Modes)
+	}
+	if secrets[3].Secret != "CERT" {
+		t.Errorf("expected selected certificate, got %q (%v)", secrets[3].Secret, secrets[3].Err)
+	}
+	if secrets[4].Err == nil {
+		t.Errorf("certificate without common name should fail")
+	}
+	if n := f.count("PUT /v1/pki/issue/web"); n != 4 {
+		t.Errorf("expected certificate per secret, got %d", n)
+	}
+	if body := f.bodies["PUT /v1/pki/issue/web"][0]; body["common_name"] != "web.example.com" || body["ttl"] != "24h" {
+		t.Errorf("unexpected request %v", body)
+	}
+
+	leases := v.Leases.Leases()
+	if len(leases) != 4 || leases[0].Name != "pki/issue/web" || leases[0].LeaseID != "" || leases[0].Duration < 3590 {
+		t.Errorf("expiry of every certificate should be tracked, got %d", len(leases))
+	}
+	if err := v.Close(); err != nil || f.count("PUT /v1/sys/leases/revoke") != 0 {
+		t.Errorf("certificates have no lease to revoke (%v)", err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"path"
 	"strings"
 
 	hcvault "hc_vault_k8s"
@@ -16,113 +15,267 @@ import (
 	"secretschain"
 )
 
+// Constants
+const (
+	OptionDynamic   = "dynamic"   // secret is read from a dynamic secrets engine (e.g. database/creds/<role>) and its lease is renewed
+	OptionNamespace = "namespace" // Vault Enterprise namespace of the secret, default is VAULT_NAMESPACE
+)
 
 // Secrets Injector struct
 type HCVaultClientStruct struct {
   	Vault               *hcvault.HCVault
-  	VaultClients        map[string]*kv.VaultClient
+  	VaultClients        map[string]*kv.VaultClient // key = namespace + mount, see clientKey
   	VaultToken          string
+	Leases              *hcvault.LeaseManager // leases of dynamic secrets
+	Role                string // Vault role to login with, VAULT_ROLE if empty
 	Chain 				*secretschain.SecretChainStruct // Chain of secrets populated from the env vars
 }
 
+func init() {
+	secretschain.RegisterProvider(secretschain.HcVaultVarName, func() secretschain.Provider { return &HCVaultClientStruct{} })
+}
+
 // Create new HC vault client and populate the environment in it
 func NewHashicorpVaultClient(ch *secretschain.SecretChainStruct) (*HCVaultClientStruct, error) {
 
 	var err error
   	v := &HCVaultClientStruct{}
-	v.VaultClients = make(map[string]*kv.VaultClient) // init map of VaultClient's
 	if ch == nil {
 		v.Chain, err = secretschain.NewSecretChain()		// let's spin up the secrets Chain and init it with the env..
 	}else{
 		v.Chain = ch
 	}
+	if err = v.Init(); err != nil {
+		return v, err
+	}
+	return v, v.Fetch( secretsOf(v.Chain, v.Name()) )
+}
+
+// Name of the origin
+func (v *HCVaultClientStruct) Name() string {
+	return secretschain.HcVaultVarName
+}
 
+// Init creates HC vault instance and authenticates
+func (v *HCVaultClientStruct) Init() error {
+	var err error
+	v.VaultClients = make(map[string]*kv.VaultClient) // init map of VaultClient's
+
+	if v.Vault, v.VaultToken, err = authenticatedVault(v.Role); err != nil {
+		return err
+	}
+	v.Leases = hcvault.NewLeaseManager()
+	return nil
+}
+
+// returns HC vault instance authenticated with env settings (and role, if set), and its token
+func authenticatedVault(role string) (*hcvault.HCVault, string, error) {
   	// This is where we create new HC vault instance
-  	v.Vault, err = hcvault.NewFromEnvironment()
+  	vault, err := hcvault.NewFromEnvironment()
 	if err != nil {
-    return v, errors.New( fmt.Sprintf("error: %s ", err.Error() ) )
+		return nil, "", errors.New( fmt.Sprintf("error: %s ", err.Error() ) )
+	}
+	if role != "" {
+		vault.Role = role
 	}
 	// .. authentication part, based on env vars from prev step
-	if v.VaultToken, err = v.Vault.Authenticate(); err != nil {
-			return v, errors.New( fmt.Sprintf("error: %s ", err.Error() ) )
+	token, err := vault.Authenticate()
+	if err != nil {
+		return nil, "", errors.New( fmt.Sprintf("error: %s ", err.Error() ) )
 	}
 	// set the token
-	v.Vault.UseToken(v.VaultToken)
-  	log.Infof("successfully authenticated to vault with new token: %s", v.VaultToken)
+	vault.UseToken(token)
+  	log.Infof("successfully authenticated to vault")
+	return vault, token, nil
+}
 
+// Fetch secrets from the vault
+func (v *HCVaultClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
   	// do some prep warm-ups
-	if err = v.Prep(); err != nil {
-		return nil, err // ops.. Huston, we have problem..
+	if err := v.Prep(secrets); err != nil {
+		return err // ops.. Huston, we have problem..
 	}
 
 	// this is main part
-	for idx, _ := range v.Chain.Secrets { // loop through all the secrets we fished out from the env.
-		if v.Chain.Secrets[idx].Origin == secretschain.HcVaultVarName { // filter out everything but Hashicrp origins
-			log.Debugf("Chain secrets with the index of %d looks like: %v", idx, v.Chain.Secrets[idx])
-			// Huston, we have Take Off!
-			// here is where we're doing some damage and pulling secrets
-			m := v.Chain.Secrets[idx].VaultPath + v.Chain.Secrets[idx].Name
-			mount := strings.SplitN( m, "/", 2)[0]
-			s, err := v.VaultClients[mount].Read( m )
-			if err != nil {
-				return v, err
+	for _, secret := range secrets { // loop through all the secrets we fished out from the env.
+		if secret.Err != nil {
+			continue // failed in prep
+		}
+		log.Debugf("Chain secret looks like: %v", secret)
+		if _, ok := secret.Options[OptionDynamic]; ok {
+			if err := v.fetchDynamic(secret); err != nil {
+				secret.Fail(err)
 			}
-			if s == nil {
-				log.Warningf("Secret '%s' not found in the vault.", v)
-				continue // moving on to the next secret in chain
-			}else{ // secret is found and its good
-				log.Debugf( "secret: %s has value: %s", v.Chain.Secrets[idx].Name, s )
-				if j, err := json.Marshal(s); err == nil {
-					v.Chain.Secrets[idx].Secret = string( j )
-				}
+			continue
+		}
+		if _, ok := secret.Options[OptionPKI]; ok {
+			if err := v.issueCertificate(secret); err != nil {
+				secret.Fail(err)
 			}
+			continue
+		}
+		// Huston, we have Take Off!
+		// here is where we're doing some damage and pulling secrets
+		m := secretPath(secret)
+		s, err := v.VaultClients[clientKey(secret, vaultMount(m))].Read( m )
+		if err != nil {
+			secret.Fail(err)
+			continue
+		}
+		if s == nil {
+			secret.Fail( fmt.Errorf("secret '%s' not found in the vault", m) )
+			continue // moving on to the next secret in chain
+		}
+		// secret is found and its good
+		j, err := json.Marshal(s)
+		if err != nil {
+			secret.Fail(err)
+			continue
+		}
+		secret.ContentType = "application/json"
+		if err := secret.SetSecret( string(j) ); err != nil {
+			secret.Fail(err)
 		}
 	}
-	return v, nil
+	return nil
 }
 
-// Prepare HC vault secrets environment and VaultClients
-func (self *HCVaultClientStruct) Prep() error { // some cleaning and cleansing.. you know orthodox stuff..
+// Close the provider, revoking leases of dynamic secrets
+func (v *HCVaultClientStruct) Close() error {
+	if v.Leases == nil {
+		return nil
+	}
+	return v.Leases.Close()
+}
 
-	secrets := make(map[string]string)
-	// prep cycle
-	for idx, _ := range self.Chain.Secrets { // preparing vault clients one by one.
-		if self.Chain.Secrets[idx].Origin == secretschain.HcVaultVarName {
-			//k := self.Chain.Secrets[idx].Name
-			//v := self.Chain.Secrets[idx].VaultPath
+// KeepTokenAlive renews the vault token with HCVault.NewRenewer, for long-running processes. When the token
+// can't be renewed anymore, OnExpire callback of Leases is called with hcvault.TokenLeaseName, see Reauthenticate
+func (v *HCVaultClientStruct) KeepTokenAlive() error {
+	if v.Leases.RenewsToken() {
+		return nil
+	}
+	renewer, err := v.Vault.NewRenewer(v.VaultToken)
+	if err != nil {
+		return err
+	}
+	v.Leases.RenewToken(renewer)
+	return nil
+}
 
-			mount := strings.SplitN( self.Chain.Secrets[idx].VaultPath + self.Chain.Secrets[idx].Name , "/" , 2 )[0]
+// Reauthenticate logs in again, e.g. when the token reached its max TTL. Kv clients are created again with the new token
+func (v *HCVaultClientStruct) Reauthenticate() error {
+	token, err := v.Vault.Authenticate()
+	if err != nil {
+		return err
+	}
+	v.VaultToken = token
+	v.Vault.UseToken(token)
+	v.VaultClients = make(map[string]*kv.VaultClient)
+	log.Infof("successfully re-authenticated to vault")
+	return nil
+}
 
-			// ensure kv.Client for mount
-			if _, ok := self.VaultClients[mount]; !ok {
-				log.Debugf("Prep: init kv.NewVClient with mount point: %s", mount)
-				secretClient, err := kv.NewVClient(self.Vault.Client(), mount+"/")
-				if err != nil {
-					return err
-				}
-				self.VaultClients[mount] = secretClient
-			}
-			// v is a secret
-			if !strings.HasSuffix( self.Chain.Secrets[idx].VaultPath, "/" ) {
-				secrets[self.Chain.Secrets[idx].Name] = self.Chain.Secrets[idx].VaultPath
-				self.Chain.Secrets[idx].Secret = self.Chain.Secrets[idx].VaultPath
-				continue
-			}
-			// v is a path -> get all secrets from v
-			keys, err := self.VaultClients[mount].List( self.Chain.Secrets[idx].VaultPath )
+// RevokeToken revokes the vault token on shutdown, together with leases created with it. Tokens given with the
+// token auth method are not owned by secret-injector and are kept
+func (v *HCVaultClientStruct) RevokeToken() error {
+	if v.Vault == nil || v.VaultToken == "" {
+		return nil
+	}
+	if v.Vault.Authenticator != nil && v.Vault.Authenticator.Method() == hcvault.AuthMethodToken {
+		log.Debugf("token of auth method %s is not revoked", hcvault.AuthMethodToken)
+		return nil
+	}
+	if err := v.Vault.Client().Auth().Token().RevokeSelf(""); err != nil {
+		return fmt.Errorf("unable to revoke vault token: %v", err)
+	}
+	v.VaultToken = ""
+	log.Infof("vault token revoked")
+	return nil
+}
+
+// fetchDynamic reads dynamic secret, e.g. database credentials, and tracks its lease. The token is renewed as well,
+// as Vault revokes leases together with the token which created them
+func (v *HCVaultClientStruct) fetchDynamic(secret *secretschain.SecretStruct) error {
+	p := secretPath(secret)
+	c, err := v.Vault.NamespaceClient(secret.Options[OptionNamespace])
+	if err != nil {
+		return err
+	}
+	s, err := c.Logical().Read(p)
+	if err != nil {
+		return err
+	}
+	if s == nil || s.Data == nil {
+		return fmt.Errorf("no dynamic secret at '%s'", p)
+	}
+	if err := v.Leases.Track(c, p, s); err != nil {
+		return err
+	}
+	if s.LeaseID != "" {
+		if err := v.KeepTokenAlive(); err != nil {
+			log.Warningf("vault token will not be renewed: %v", err)
+		}
+	}
+	j, err := json.Marshal(s.Data)
+	if err != nil {
+		return err
+	}
+	secret.ContentType = "application/json"
+	return secret.SetSecret(string(j))
+}
+
+// Prepare HC vault secrets environment - one kv.VaultClient per mount, secrets may come from several mounts at once
+func (self *HCVaultClientStruct) Prep(secrets []*secretschain.SecretStruct) error { // some cleaning and cleansing.. you know orthodox stuff..
+
+	for _, secret := range secrets { // preparing vault clients one by one.
+		if !isKVSecret(secret) {
+			continue // read without kv client
+		}
+		p := secretPath(secret)
+		mount := vaultMount(p)
+		if mount == "" || mount == p {
+			secret.Fail( fmt.Errorf("secret has no path within the vault: set VAULT_PATH or use full path, e.g. secret/%s", secret.Name) )
+			continue
+		}
+
+		// ensure kv.Client for namespace and mount
+		key := clientKey(secret, mount)
+		if _, ok := self.VaultClients[key]; !ok {
+			log.Debugf("Prep: init kv.NewVClient with mount point: %s", key)
+			c, err := self.Vault.NamespaceClient(secret.Options[OptionNamespace])
 			if err != nil {
 				return err
 			}
-			if keys == nil {
-				continue	// moving on to the next
-			}
-			// TODO: check for secret == nil
-			for _, key := range keys {
-				self.Chain.Secrets[idx].Secret = path.Join(self.Chain.Secrets[idx].VaultPath, key)
+			secretClient, err := kv.NewVClient(c, mount+"/")
+			if err != nil {
+				secret.Fail(err) // e.g. no access to the mount in the namespace, other secrets may still work
+				continue
 			}
+			self.VaultClients[key] = secretClient
 		}
-		//self.EnvVars.Secrets = secrets
 	}
 
 	return nil
 }
+
+// reports whether secret is read from K/V engine, i.e. it is not dynamic secret nor certificate
+func isKVSecret(s *secretschain.SecretStruct) bool {
+	_, dynamic := s.Options[OptionDynamic]
+	_, pki := s.Options[OptionPKI]
+	return !dynamic && !pki
+}
+
+// returns full path of the secret within the vault
+func secretPath(s *secretschain.SecretStruct) string {
+	return strings.TrimPrefix(s.VaultPath + s.Name, "/")
+}
+
+// returns key of the kv client for the secret: namespace of the secret and mount
+func clientKey(s *secretschain.SecretStruct, mount string) string {
+	return strings.Trim(s.Options[OptionNamespace], "/") + "|" + mount
+}
+
+// returns mount of the secret engine for path p, i.e. its first element
+func vaultMount(p string) string {
+	return strings.SplitN(p, "/", 2)[0]
+}
@@ -0,0 +1,175 @@
+package secretsinjector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"secretschain"
+)
+
+// vaultStub serves Vault API responses by method and path, e.g. "GET /v1/database/creds/readonly",
+// prefixed with the namespace of the request, if any, e.g. "ns=bu1 GET /v1/sys/mounts", and records the requests
+type vaultStub struct {
+	mu        sync.Mutex
+	responses map[string]string
+	bodies    map[string][]map[string]interface{} // request -> JSON bodies
+	tokens    map[string][]string                 // request -> tokens
+}
+
+func (f *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := r.Method + " " + r.URL.Path
+	if ns := r.Header.Get("X-Vault-Namespace"); ns != "" {
+		req = "ns=" + ns + " " + req
+	}
+	body := map[string]interface{}{}
+	b, _ := ioutil.ReadAll(r.Body)
+	_ = json.Unmarshal(b, &body)
+
+	f.mu.Lock()
+	f.bodies[req] = append(f.bodies[req], body)
+	f.tokens[req] = append(f.tokens[req], r.Header.Get("X-Vault-Token"))
+	resp, ok := f.responses[req]
+	f.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+	if resp == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(resp))
+}
+
+// count returns number of requests req
+func (f *vaultStub) count(req string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.bodies[req])
+}
+
+// starts stub and returns hashicorpvault provider logged in to it with token auth method, and cleanup
+func newVaultStub(t *testing.T, responses map[string]string) (*vaultStub, *HCVaultClientStruct, func()) {
+	f := &vaultStub{responses: responses, bodies: map[string][]map[string]interface{}{}, tokens: map[string][]string{}}
+	server := httptest.NewServer(f)
+	env := map[string]string{
+		"VAULT_ADDR":        server.URL,
+		"VAULT_AUTH_METHOD": "token",
+		"VAULT_TOKEN":       "s.test",
+		"VAULT_TOKEN_PATH":  "/nonexistent/.vault-token",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	v := &HCVaultClientStruct{}
+	if err := v.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return f, v, func() {
+		server.Close()
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestHCVaultDynamicSecret(t *testing.T) {
+	t.Log("Testing leases of dynamic secrets are renewed and revoked")
+	f, v, cleanup := newVaultStub(t, map[string]string{
+		"GET /v1/database/creds/readonly": `{"lease_id":"database/creds/readonly/l1","lease_duration":2,"renewable":true,
+			"data":{"username":"v-app","password":"p1"}}`,
+		"GET /v1/database/creds/report": `{"lease_id":"database/creds/report/l2","lease_duration":1,"renewable":false,
+			"data":{"username":"v-report","password":"p2"}}`,
+		"PUT /v1/sys/leases/renew":      `{"lease_id":"database/creds/readonly/l1","lease_duration":2,"renewable":true}`,
+		"PUT /v1/auth/token/renew-self": `{"auth":{"client_token":"s.test","lease_duration":3600,"renewable":true}}`,
+		"PUT /v1/sys/leases/revoke":     "",
+	})
+	defer cleanup()
+
+	expired := make(chan string, 1)
+	v.Leases.OnExpire(func(name string) { expired <- name })
+	dynamic := map[string]string{OptionDynamic: ""}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "readonly", VaultPath: "database/creds/", Field: "password", Options: dynamic},
+		{Name: "report", VaultPath: "database/creds/", Field: "username", Options: dynamic},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "p1" || secrets[1].Secret != "v-report" {
+		t.Errorf("unexpected values: %q (%v), %q (%v)", secrets[0].Secret, secrets[0].Err, secrets[1].Secret, secrets[1].Err)
+	}
+	if len(v.Leases.Leases()) != 2 || !v.Leases.RenewsToken() {
+		t.Fatalf("leases and token should be tracked, got %d leases", len(v.Leases.Leases()))
+	}
+
+	select {
+	case name := <-expired:
+		if name != "database/creds/report" {
+			t.Errorf("unexpected expired lease %s", name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("not renewable lease should expire at 2/3 of its duration")
+	}
+	for deadline := time.Now().Add(3 * time.Second); f.count("PUT /v1/sys/leases/renew") == 0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if f.count("PUT /v1/sys/leases/renew") == 0 {
+		t.Errorf("renewable lease was not renewed")
+	} else if id := f.bodies["PUT /v1/sys/leases/renew"][0]["lease_id"]; id != "database/creds/readonly/l1" {
+		t.Errorf("unexpected lease renewed: %v", id)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	revoked := f.bodies["PUT /v1/sys/leases/revoke"]
+	if len(revoked) != 1 || revoked[0]["lease_id"] != "database/creds/readonly/l1" {
+		t.Errorf("expected revocation of the remaining lease, got %v", revoked)
+	}
+}
+
+func TestHCVaultNamespaces(t *testing.T) {
+	t.Log("Testing secrets of Vault Enterprise namespaces")
+	mounts := `{"data":{"secret/":{"type":"kv","options":{"version":"2"}}}}`
+	f, v, cleanup := newVaultStub(t, map[string]string{
+		"GET /v1/sys/mounts":                          mounts,
+		"GET /v1/secret/data/db":                      `{"data":{"data":{"password":"root-ns"}}}`,
+		"ns=bu1/payments GET /v1/sys/mounts":          mounts,
+		"ns=bu1/payments GET /v1/secret/data/db":      `{"data":{"data":{"password":"payments-ns"}}}`,
+		"ns=bu1/payments GET /v1/secret/data/api-key": `{"data":{"data":{"key":"k1"}}}`,
+	})
+	defer cleanup()
+
+	payments := map[string]string{OptionNamespace: "bu1/payments"}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "db", VaultPath: "secret/", Field: "password"},
+		{Name: "db", VaultPath: "secret/", Field: "password", Options: payments},
+		{Name: "api-key", VaultPath: "secret/", Field: "key", Options: map[string]string{OptionNamespace: "/bu1/payments/"}},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "root-ns" || secrets[1].Secret != "payments-ns" || secrets[2].Secret != "k1" {
+		t.Errorf("unexpected values: %q (%v), %q (%v), %q (%v)", secrets[0].Secret, secrets[0].Err,
+			secrets[1].Secret, secrets[1].Err, secrets[2].Secret, secrets[2].Err)
+	}
+	if len(v.VaultClients) != 2 || v.VaultClients["|secret"] == nil || v.VaultClients["bu1/payments|secret"] == nil {
+		t.Errorf("expected kv client per namespace and mount, got %v", v.VaultClients)
+	}
+	if f.count("GET /v1/sys/mounts") != 1 || f.count("ns=bu1/payments GET /v1/sys/mounts") != 1 {
+		t.Errorf("kv clients should be created once per namespace and mount")
+	}
+	if tokens := f.tokens["ns=bu1/payments GET /v1/secret/data/db"]; len(tokens) != 1 || tokens[0] != "s.test" {
+		t.Errorf("namespace client should share token of the login, got %v", tokens)
+	}
+}
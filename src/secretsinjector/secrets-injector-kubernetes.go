@@ -0,0 +1,179 @@
+// Package provides capabilities to retrieve values of Kubernetes Secrets and ConfigMaps
+//
+
+package secretsinjector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	hcvault "hc_vault_k8s"
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	KubernetesVarName = "kubernetes"
+	OptionKind        = "kind" // secret (default) or configmap
+	KindConfigMap     = "configmap"
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+// Kubernetes struct
+type KubernetesClientStruct struct {
+	Client    kubernetes.Interface
+	Namespace string
+}
+
+func init() {
+	secretschain.RegisterProvider(KubernetesVarName, func() secretschain.Provider { return &KubernetesClientStruct{} })
+}
+
+// Name of the origin
+func (v *KubernetesClientStruct) Name() string {
+	return KubernetesVarName
+}
+
+// Init creates client for the API server, authenticated with pod's service-account token
+// (SERVICE_ACCOUNT_TOKEN_PATH, same as for Hashicorp Vault auth). Namespace is the pod's namespace
+func (v *KubernetesClientStruct) Init() error {
+	if v.Namespace == "" {
+		v.Namespace = podNamespace()
+	}
+	if v.Namespace == "" {
+		return fmt.Errorf("unable to determine namespace of the pod, set POD_NAMESPACE")
+	}
+	if v.Client != nil {
+		return nil // already set, e.g. by tests
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("unable to find API server, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	tokenPath := utils.GetEnvVariableByName("SERVICE_ACCOUNT_TOKEN_PATH")
+	if tokenPath == "" {
+		tokenPath = hcvault.ServiceAccountTokenPath
+	}
+	config := &rest.Config{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		BearerTokenFile: tokenPath,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: serviceAccountDir + "ca.crt"},
+	}
+	var err error
+	if v.Client, err = kubernetes.NewForConfig(config); err != nil {
+		return fmt.Errorf("unable to create Kubernetes client: %v", err)
+	}
+	return nil
+}
+
+// Fetch values, addressed as <secretName>/<key>. Reference without key (<secretName>) selects all keys as JSON object.
+// ConfigMaps are selected with ?kind=configmap
+func (v *KubernetesClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		name, key := strings.TrimSuffix(s.VaultPath, "/"), s.Name
+		if name == "" { // no key given
+			name, key = s.Name, ""
+		}
+		if strings.Contains(name, "/") {
+			s.Fail(fmt.Errorf("invalid reference %s%s, expected <name>/<key>", s.VaultPath, s.Name))
+			continue
+		}
+
+		data, err := v.data(strings.ToLower(s.Options[OptionKind]), name)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		if key == "" {
+			j, _ := json.Marshal(data)
+			s.ContentType = "application/json"
+			err = s.SetSecret(string(j))
+		} else if value, ok := data[key]; ok {
+			err = s.SetSecret(value)
+		} else {
+			err = fmt.Errorf("key %s not found in %s/%s", key, v.Namespace, name)
+		}
+		if err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Close the provider
+func (v *KubernetesClientStruct) Close() error {
+	return nil
+}
+
+// returns data of Secret or ConfigMap
+func (v *KubernetesClientStruct) data(kind, name string) (map[string]string, error) {
+	log.Debugf("retrieving %s %s/%s from Kubernetes", kind, v.Namespace, name)
+	data := make(map[string]string)
+	var err error
+	switch kind {
+	case "", "secret":
+		var secret *corev1.Secret
+		if secret, err = v.Client.CoreV1().Secrets(v.Namespace).Get(context.Background(), name, metav1.GetOptions{}); err == nil {
+			for k, b := range secret.Data {
+				data[k] = string(b)
+			}
+			for k, s := range secret.StringData {
+				data[k] = s
+			}
+		}
+	case KindConfigMap:
+		var cm *corev1.ConfigMap
+		if cm, err = v.Client.CoreV1().ConfigMaps(v.Namespace).Get(context.Background(), name, metav1.GetOptions{}); err == nil {
+			for k, s := range cm.Data {
+				data[k] = s
+			}
+			for k, b := range cm.BinaryData {
+				data[k] = string(b)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown kind %s, expected secret or configmap", kind)
+	}
+
+	switch {
+	case err == nil:
+		return data, nil
+	case k8serrors.IsNotFound(err):
+		return nil, fmt.Errorf("%s %s/%s not found", kindOrSecret(kind), v.Namespace, name)
+	case k8serrors.IsForbidden(err):
+		return nil, fmt.Errorf("access to %s %s/%s denied: %v", kindOrSecret(kind), v.Namespace, name, err)
+	}
+	return nil, err
+}
+
+func kindOrSecret(kind string) string {
+	if kind == "" {
+		return "secret"
+	}
+	return kind
+}
+
+// returns namespace of the pod from POD_NAMESPACE (downward API) or service-account mount
+func podNamespace() string {
+	if ns := utils.GetEnvVariableByName("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if b, err := ioutil.ReadFile(serviceAccountDir + "namespace"); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	return ""
+}
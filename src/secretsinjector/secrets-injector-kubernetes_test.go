@@ -0,0 +1,56 @@
+package secretsinjector
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"secretschain"
+)
+
+func TestKubernetesFetch(t *testing.T) {
+	t.Log("Testing Kubernetes provider against fake clientset")
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-tls", Namespace: "apps"},
+			Data:       map[string][]byte{"tls.crt": []byte("CERT"), "tls.key": []byte("KEY")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "apps"},
+			Data:       map[string]string{"log-level": "debug"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-ns", Namespace: "default"},
+			Data:       map[string][]byte{"key": []byte("value")},
+		},
+	)
+	p := &KubernetesClientStruct{Client: client, Namespace: "apps"}
+	if err := p.Init(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	secrets := []*secretschain.SecretStruct{
+		{VaultPath: "web-tls/", Name: "tls.crt"},
+		{VaultPath: "settings/", Name: "log-level", Options: map[string]string{OptionKind: "ConfigMap"}},
+		{Name: "web-tls", Options: map[string]string{secretschain.OptionExpand: "TLS_"}},
+		{VaultPath: "web-tls/", Name: "ca.crt"},
+		{VaultPath: "other-ns/", Name: "key"},
+	}
+	if err := p.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "CERT" || secrets[1].Secret != "debug" {
+		t.Errorf("unexpected values: %q %q", secrets[0].Secret, secrets[1].Secret)
+	}
+	if secrets[2].Values["tls.key"] != "KEY" {
+		t.Errorf("whole secret should be expanded: %v (%v)", secrets[2].Values, secrets[2].Err)
+	}
+	if secrets[3].Err == nil {
+		t.Errorf("missing key should fail")
+	}
+	if secrets[4].Err == nil {
+		t.Errorf("secrets of other namespaces must not be visible")
+	}
+}
@@ -0,0 +1,120 @@
+// Package provides capabilities to retrieve secrets from SOPS encrypted files
+//
+// Files are decrypted in-process, no network is needed with age keys. The age identity comes
+// from SOPS_AGE_KEY_FILE (e.g. mounted Kubernetes Secret) or SOPS_AGE_KEY, as for the sops CLI.
+//
+
+package secretsinjector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getsops/sops/v3/decrypt"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	SopsVarName        = "sops"
+	SopsFileVarName    = "SOPS_FILE"         // path of the encrypted file, overridden per secret with ?path=
+	SopsAgeKeyFileName = "SOPS_AGE_KEY_FILE" // file with age identities, one per line
+	SopsAgeKeyName     = "SOPS_AGE_KEY"      // age identities
+)
+
+// SOPS struct
+type SopsClientStruct struct {
+	docs map[string]string // path -> decrypted file as JSON document
+}
+
+func init() {
+	secretschain.RegisterProvider(SopsVarName, func() secretschain.Provider { return &SopsClientStruct{} })
+}
+
+// Name of the origin
+func (v *SopsClientStruct) Name() string {
+	return SopsVarName
+}
+
+// Init the provider, files are decrypted on first use
+func (v *SopsClientStruct) Init() error {
+	if utils.GetEnvVariableByName(SopsAgeKeyFileName) == "" && utils.GetEnvVariableByName(SopsAgeKeyName) == "" {
+		log.Warningf("neither %s nor %s is set, SOPS files can be decrypted only with other key sources", SopsAgeKeyFileName, SopsAgeKeyName)
+	}
+	v.docs = make(map[string]string)
+	return nil
+}
+
+// Fetch secrets, addressed as path.to.key (or path/to/key) in the decrypted file
+func (v *SopsClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	for _, s := range secrets {
+		p := utils.GetEnvVariableByName(SopsFileVarName)
+		if o := s.Options[OptionPath]; o != "" {
+			p = o
+		}
+		if p == "" {
+			s.Fail(fmt.Errorf("no SOPS file given, set %s or ?%s=", SopsFileVarName, OptionPath))
+			continue
+		}
+		doc, err := v.load(p)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		if err := lookupDocument(doc, s, p); err != nil {
+			s.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Close the provider, dropping decrypted documents
+func (v *SopsClientStruct) Close() error {
+	v.docs = nil
+	return nil
+}
+
+// decrypts file p into JSON document. Format follows the extension of the file
+func (v *SopsClientStruct) load(p string) (string, error) {
+	if doc, ok := v.docs[p]; ok {
+		return doc, nil
+	}
+	if _, err := os.Stat(p); err != nil {
+		return "", fmt.Errorf("unable to read SOPS file: %v", err)
+	}
+
+	format := "yaml"
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".json":
+		format = "json"
+	case ".env":
+		format = "dotenv"
+	}
+	b, err := decrypt.File(p, format)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt SOPS file %s: %v", p, err)
+	}
+
+	var j []byte
+	if format == "dotenv" {
+		var m map[string]string
+		if m, err = ParseDotenv(b); err == nil {
+			j, err = json.Marshal(m)
+		}
+	} else {
+		j, err = yaml.YAMLToJSON(b) // JSON is valid YAML
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to parse decrypted SOPS file %s: %v", p, err)
+	}
+	log.Debugf("decrypted SOPS file %s", p)
+	v.docs[p] = string(j)
+	return v.docs[p], nil
+}
@@ -0,0 +1,59 @@
+package secretsinjector
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"secretschain"
+)
+
+// testdata/sops-*.enc.* are encrypted for the throwaway identity of testdata/sops-age.key
+func TestSopsFetch(t *testing.T) {
+	t.Log("Testing SOPS provider with age encrypted files")
+	key, err := ioutil.ReadFile("testdata/sops-age.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := map[string]string{OptionPath: "testdata/sops-other.enc.json"}
+	cases := []struct {
+		name   string
+		env    map[string]string
+		secret secretschain.SecretStruct
+		value  string // empty if the secret should fail
+	}{
+		{"path.to.key with SOPS_AGE_KEY_FILE", map[string]string{SopsAgeKeyFileName: "testdata/sops-age.key"},
+			secretschain.SecretStruct{Name: "app.db.password"}, "s3cr3t"},
+		{"path/to/key with SOPS_AGE_KEY", map[string]string{SopsAgeKeyName: strings.TrimSpace(string(key))},
+			secretschain.SecretStruct{Name: "password", VaultPath: "app/db/"}, "s3cr3t"},
+		{"file overridden with ?path=", map[string]string{SopsAgeKeyFileName: "testdata/sops-age.key"},
+			secretschain.SecretStruct{Name: "token", Options: other}, "from-json"},
+		{"missing key", map[string]string{SopsAgeKeyFileName: "testdata/sops-age.key"},
+			secretschain.SecretStruct{Name: "app.db.username"}, ""},
+		{"wrong identity", map[string]string{SopsAgeKeyFileName: "testdata/sops-wrong-age.key"},
+			secretschain.SecretStruct{Name: "token"}, ""},
+	}
+	os.Setenv(SopsFileVarName, "testdata/sops-secrets.enc.yaml")
+	defer os.Unsetenv(SopsFileVarName)
+	for _, c := range cases {
+		for k, v := range c.env {
+			os.Setenv(k, v)
+		}
+		v := &SopsClientStruct{}
+		_ = v.Init()
+		s := c.secret
+		if err := v.Fetch([]*secretschain.SecretStruct{&s}); err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if c.value == "" && s.Err == nil {
+			t.Errorf("%s: expected error, got %q", c.name, s.Secret)
+		}
+		if c.value != "" && (s.Secret != c.value || s.Err != nil) {
+			t.Errorf("%s: expected %q, got %q (%v)", c.name, c.value, s.Secret, s.Err)
+		}
+		for k := range c.env {
+			os.Unsetenv(k)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package provides capabilities to decrypt ciphertexts with Hashicorp Vault Transit secrets engine
+//
+// Ciphertexts are committed with the manifests, e.g. DB_PASS=vault:v1:AbC...@transit?key=app,
+// and decrypted at startup, one batch request per key. Requests use the login of the hashicorpvault provider
+// of the chain, so there is one Vault token to renew and revoke.
+//
+
+package secretsinjector
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+
+	hcvault "hc_vault_k8s"
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	TransitVarName      = "transit"
+	TransitKeyName      = "VAULT_TRANSIT_KEY"   // default key, overridden per secret with ?key=
+	TransitMountName    = "VAULT_TRANSIT_MOUNT" // mount of the engine, overridden per secret with ?mount=, default transit
+	OptionKey           = "key"                 // name of the encryption key
+	OptionMount         = "mount"               // mount of the transit engine
+	OptionFile          = "file"                // name of the file, required for file secrets
+	defaultTransitMount = "transit"
+)
+
+// Vault logical writer, replaced in tests
+type vaultWriter interface {
+	Write(path string, data map[string]interface{}) (*api.Secret, error)
+}
+
+// Transit struct
+type TransitClientStruct struct {
+	Vault   *hcvault.HCVault // of the hashicorpvault provider
+	Logical vaultWriter      // set by tests, otherwise client of VAULT_NAMESPACE
+	chain   *secretschain.SecretChainStruct
+}
+
+func init() {
+	secretschain.RegisterProvider(TransitVarName, func() secretschain.Provider { return &TransitClientStruct{} })
+}
+
+// Name of the origin
+func (v *TransitClientStruct) Name() string {
+	return TransitVarName
+}
+
+// SetChain sets chain, whose hashicorpvault provider is used
+func (v *TransitClientStruct) SetChain(chain *secretschain.SecretChainStruct) {
+	v.chain = chain
+}
+
+// Init takes authenticated HC vault of the hashicorpvault provider, initializing it if the chain has no vault secrets
+func (v *TransitClientStruct) Init() error {
+	if v.Logical != nil {
+		return nil // already set, e.g. by tests
+	}
+	if v.chain == nil {
+		return fmt.Errorf("provider %s is used with secrets chain only", TransitVarName)
+	}
+	p, err := v.chain.InitProvider(secretschain.HcVaultVarName)
+	if err != nil {
+		return err
+	}
+	hc, ok := p.(*HCVaultClientStruct)
+	if !ok {
+		return fmt.Errorf("provider %s needs provider %s, got %s", TransitVarName, secretschain.HcVaultVarName, p.Name())
+	}
+	v.Vault = hc.Vault
+	return nil
+}
+
+// decrypt endpoint in a namespace
+type transitBatch struct {
+	namespace, path string
+}
+
+// Fetch decrypts ciphertexts, batching them per namespace and key
+func (v *TransitClientStruct) Fetch(secrets []*secretschain.SecretStruct) error {
+	batches := make(map[transitBatch][]*secretschain.SecretStruct)
+	order := []transitBatch{}
+	for _, s := range secrets {
+		if err := setTransitFile(s); err != nil {
+			s.Fail(err)
+			continue
+		}
+		key := s.Options[OptionKey]
+		if key == "" {
+			key = utils.GetEnvVariableByName(TransitKeyName)
+		}
+		if key == "" {
+			s.Fail(fmt.Errorf("no transit key given, set %s or ?%s=", TransitKeyName, OptionKey))
+			continue
+		}
+		mount := s.Options[OptionMount]
+		if mount == "" {
+			mount = utils.GetEnvVariableByName(TransitMountName)
+		}
+		if mount == "" {
+			mount = defaultTransitMount
+		}
+		b := transitBatch{namespace: s.Options[OptionNamespace], path: path.Join(mount, "decrypt", key)}
+		if _, ok := batches[b]; !ok {
+			order = append(order, b)
+		}
+		batches[b] = append(batches[b], s)
+	}
+	for _, b := range order {
+		v.decrypt(b, batches[b])
+	}
+	return nil
+}
+
+// sets name of the file of a file secret from ?file=. Name can't be taken from the reference, its last segment
+// is a piece of base64 ciphertext
+func setTransitFile(s *secretschain.SecretStruct) error {
+	if s.FilePath == "" {
+		return nil
+	}
+	name, ok := s.Options[OptionFile]
+	if !ok {
+		if s.File != s.Name {
+			return nil // named by the manifest
+		}
+		return fmt.Errorf("file secret of %s needs a file name, set ?%s=<name>", TransitVarName, OptionFile)
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	s.File = name
+	return nil
+}
+
+// Close the provider, the token belongs to the hashicorpvault provider
+func (v *TransitClientStruct) Close() error {
+	return nil
+}
+
+// returns writer of the decrypt requests in namespace ns, VAULT_NAMESPACE if empty. Client is taken per request,
+// as the token changes with re-authentication
+func (v *TransitClientStruct) logical(ns string) (vaultWriter, error) {
+	if v.Logical != nil {
+		return v.Logical, nil
+	}
+	c, err := v.Vault.NamespaceClient(ns)
+	if err != nil {
+		return nil, err
+	}
+	return c.Logical(), nil
+}
+
+// decrypts batch of ciphertexts with endpoint of b
+func (v *TransitClientStruct) decrypt(b transitBatch, secrets []*secretschain.SecretStruct) {
+	p := b.path
+	input := []map[string]interface{}{}
+	for _, s := range secrets {
+		input = append(input, map[string]interface{}{"ciphertext": ciphertext(s)})
+	}
+	log.Debugf("decrypting %d ciphertext(s) with %s", len(secrets), p)
+	var resp *api.Secret
+	logical, err := v.logical(b.namespace)
+	if err == nil {
+		resp, err = logical.Write(p, map[string]interface{}{"batch_input": input})
+	}
+	if err == nil && (resp == nil || resp.Data == nil) {
+		err = fmt.Errorf("empty response of %s", p)
+	}
+	results, ok := []interface{}{}, false
+	if err == nil {
+		if results, ok = resp.Data["batch_results"].([]interface{}); !ok || len(results) != len(secrets) {
+			err = fmt.Errorf("unexpected response of %s", p)
+		}
+	}
+	if err != nil {
+		for _, s := range secrets {
+			s.Fail(err)
+		}
+		return
+	}
+
+	for idx, s := range secrets {
+		r, _ := results[idx].(map[string]interface{})
+		if e, _ := r["error"].(string); e != "" {
+			s.Fail(fmt.Errorf("unable to decrypt with %s: %s", p, e))
+			continue
+		}
+		encoded, _ := r["plaintext"].(string)
+		plaintext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			s.Fail(fmt.Errorf("unable to decode plaintext: %v", err))
+			continue
+		}
+		if err := s.SetSecret(string(plaintext)); err != nil {
+			s.Fail(err)
+		}
+	}
+}
+
+// returns ciphertext of the secret. Base64 may contain '/', which the parser takes for path separator
+func ciphertext(s *secretschain.SecretStruct) string {
+	return s.VaultPath + s.Name
+}
@@ -0,0 +1,116 @@
+package secretsinjector
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+
+	"secretschain"
+)
+
+// fake transit engine, "decrypts" ciphertexts vault:v1:<base64 plaintext> of key app
+type fakeTransit struct {
+	calls int
+}
+
+func (f *fakeTransit) Write(path string, data map[string]interface{}) (*api.Secret, error) {
+	f.calls++
+	if path != "transit/decrypt/app" {
+		return nil, fmt.Errorf("Error making API request: Code: 400. Errors: encryption key not found")
+	}
+	results := []interface{}{}
+	for _, in := range data["batch_input"].([]map[string]interface{}) {
+		ct := in["ciphertext"].(string)
+		if len(ct) < 9 || ct[:9] != "vault:v1:" {
+			results = append(results, map[string]interface{}{"error": "invalid ciphertext: no prefix"})
+			continue
+		}
+		results = append(results, map[string]interface{}{"plaintext": ct[9:]})
+	}
+	return &api.Secret{Data: map[string]interface{}{"batch_results": results}}, nil
+}
+
+func TestTransitFetch(t *testing.T) {
+	t.Log("Testing Vault Transit provider against fake engine")
+	f := &fakeTransit{}
+	v := &TransitClientStruct{Logical: f}
+	_ = v.Init()
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	app := map[string]string{OptionKey: "app"}
+	secrets := []*secretschain.SecretStruct{
+		{Name: "vault:v1:" + b64("s3cr3t"), Options: app},
+		{Name: "vault:v1:" + b64(`{"user":"app"}`), Field: "user", Options: app},
+		{Name: "garbage", Options: app},
+		{Name: "vault:v1:" + b64("x"), Options: map[string]string{OptionKey: "other"}},
+		{Name: "vault:v1:" + b64("x")},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].Secret != "s3cr3t" || secrets[1].Secret != "app" {
+		t.Errorf("unexpected values: %q %q", secrets[0].Secret, secrets[1].Secret)
+	}
+	for _, s := range secrets[2:] {
+		if s.Err == nil {
+			t.Errorf("secret %s should fail", s.Name)
+		}
+	}
+	if f.calls != 2 {
+		t.Errorf("expected one batch per key, got %d requests", f.calls)
+	}
+}
+
+func TestTransitFileName(t *testing.T) {
+	t.Log("Testing file secrets of Transit are named with ?file=")
+	v := &TransitClientStruct{Logical: &fakeTransit{}}
+	b64 := base64.StdEncoding.EncodeToString([]byte("s3cr3t"))
+	secrets := []*secretschain.SecretStruct{
+		{Name: "Zm9v", VaultPath: "vault:v1:abc/", FilePath: "/etc/secrets/", File: "Zm9v", Options: map[string]string{OptionKey: "app", OptionFile: "db-password"}},
+		{Name: "vault:v1:" + b64, FilePath: "/etc/secrets/", File: "db-password", Options: map[string]string{OptionKey: "app"}},
+		{Name: "Zm9v", VaultPath: "vault:v1:abc/", FilePath: "/etc/secrets/", File: "Zm9v", Options: map[string]string{OptionKey: "app"}},
+		{Name: "vault:v1:" + b64, FilePath: "/etc/secrets/", File: "x", Options: map[string]string{OptionKey: "app", OptionFile: "../x"}},
+	}
+	if err := v.Fetch(secrets); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secrets[0].File != "db-password" || secrets[1].Err != nil || secrets[1].File != "db-password" {
+		t.Errorf("unexpected files %q %q (%v)", secrets[0].File, secrets[1].File, secrets[1].Err)
+	}
+	if secrets[2].Err == nil || secrets[3].Err == nil {
+		t.Errorf("file secrets without valid ?%s= should fail", OptionFile)
+	}
+}
+
+func TestTransitSharesVaultLogin(t *testing.T) {
+	t.Log("Testing Transit provider uses login of the hashicorpvault provider")
+	f, _, cleanup := newVaultStub(t, map[string]string{
+		"PUT /v1/transit/decrypt/app":        `{"data":{"batch_results":[{"plaintext":"` + base64.StdEncoding.EncodeToString([]byte("s3cr3t")) + `"}]}}`,
+		"ns=bu1 PUT /v1/transit/decrypt/app": `{"data":{"batch_results":[{"plaintext":"` + base64.StdEncoding.EncodeToString([]byte("bu1")) + `"}]}}`,
+	})
+	defer cleanup()
+
+	chain, err := secretschain.NewSecretChainFromReferences(map[string]string{
+		"DB_PASS":     "vault:v1:abc@transit?key=app",
+		"DB_PASS_BU1": "vault:v1:abc@transit?key=app&namespace=bu1",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := chain.Resolve(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if env, _ := chain.Environment(); env["DB_PASS"] != "s3cr3t" || env["DB_PASS_BU1"] != "bu1" {
+		t.Errorf("unexpected values %q %q", env["DB_PASS"], env["DB_PASS_BU1"])
+	}
+	transit, _ := chain.Provider(TransitVarName).(*TransitClientStruct)
+	hc, _ := chain.Provider(secretschain.HcVaultVarName).(*HCVaultClientStruct)
+	if transit == nil || hc == nil || transit.Vault != hc.Vault {
+		t.Errorf("transit provider should share vault of the hashicorpvault provider")
+	}
+	if f.count("PUT /v1/transit/decrypt/app") != 1 || f.count("ns=bu1 PUT /v1/transit/decrypt/app") != 1 {
+		t.Errorf("expected one decrypt request per namespace")
+	}
+	_ = chain.Close()
+}
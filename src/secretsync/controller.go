@@ -0,0 +1,419 @@
+// Package secretsync implements controller which syncs vault secrets into native Kubernetes Secrets
+//
+// Controller watches SecretSync resources and queues them when they are created or their spec changes,
+// then again after their refreshInterval (or RetryInterval, if the sync failed). References are checked
+// against the Policy of the namespace first (see policy.go).
+//
+
+package secretsync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	hcvault "hc_vault_k8s"
+	"secretschain"
+	"secretsexport"
+	secinject "secretsinjector" // also registers secret providers
+	"utils"
+)
+
+// Constants
+const (
+	NamespaceVarName     = "SECRETSYNC_NAMESPACE" // watched namespace, all namespaces if not set
+	DefaultRetryInterval = time.Minute
+)
+
+// Resolver resolves secret references (key -> reference) of a SecretSync in the namespace into values, keys which
+// failed are returned in failed. Error means the references are invalid
+type Resolver func(namespace string, refs map[string]string) (values map[string]string, failed map[string]error, err error)
+
+// Controller syncs SecretSync resources into Secrets
+type Controller struct {
+	Dynamic       dynamic.Interface
+	Client        kubernetes.Interface
+	Namespace     string   // watched namespace, all namespaces if empty
+	Policy        *Policy  // what SecretSyncs of a namespace may resolve, nothing if nil
+	Resolve       Resolver // ResolveReferences, unless replaced by tests
+	RetryInterval time.Duration
+	queue         workqueue.RateLimitingInterface
+	chains        map[string]*secretschain.SecretChainStruct // providers by Vault role, kept for the controller's lifetime
+	expired       *hcvault.ExpirySet                         // Vault roles whose token can't be renewed anymore
+}
+
+// Secret exists and is not owned by the SecretSync
+type conflictError struct{ msg string }
+
+func (e *conflictError) Error() string { return e.msg }
+
+// New returns controller using the clients and the policy
+func New(dyn dynamic.Interface, client kubernetes.Interface, namespace string, policy *Policy) *Controller {
+	c := &Controller{
+		Dynamic:       dyn,
+		Client:        client,
+		Namespace:     namespace,
+		Policy:        policy,
+		RetryInterval: DefaultRetryInterval,
+		queue:         workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		chains:        make(map[string]*secretschain.SecretChainStruct),
+		expired:       hcvault.NewExpirySet(),
+	}
+	c.Resolve = c.ResolveReferences
+	return c
+}
+
+// NewFromEnvironment returns controller with in-cluster clients, watching SECRETSYNC_NAMESPACE,
+// with the policy SECRETSYNC_POLICY_FILE
+func NewFromEnvironment() (*Controller, error) {
+	p := utils.GetEnvVariableByName(PolicyFileVarName)
+	if p == "" {
+		return nil, fmt.Errorf("missing %s, the controller needs policy of the namespaces", PolicyFileVarName)
+	}
+	policy, err := LoadPolicy(p)
+	if err != nil {
+		return nil, err
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure Kubernetes client: %v", err)
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Kubernetes client: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Kubernetes client: %v", err)
+	}
+	return New(dyn, client, utils.GetEnvVariableByName(NamespaceVarName), policy), nil
+}
+
+// Run watches SecretSync resources and syncs them until ctx is done. Syncs run one at a time,
+// as providers of secretschain are not meant to be used concurrently. Providers are closed on return
+func (c *Controller) Run(ctx context.Context) error {
+	defer c.Close()
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.Dynamic, 0, c.Namespace, nil)
+	informer := factory.ForResource(Resource).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			// status updates of the controller itself don't change generation
+			o, oerr := meta.Accessor(old)
+			n, nerr := meta.Accessor(new)
+			if oerr == nil && nerr == nil && o.GetGeneration() != n.GetGeneration() {
+				c.enqueue(new)
+			}
+		},
+	})
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("unable to list %s", Resource.String())
+	}
+	log.Infof("syncing %s in namespace '%s'", Resource.String(), c.Namespace)
+
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNext(ctx) {
+	}
+	return nil
+}
+
+// Close revokes Vault tokens of the controller and closes its providers
+func (c *Controller) Close() {
+	for role, chain := range c.chains {
+		if hc, ok := chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct); ok {
+			if err := hc.RevokeToken(); err != nil {
+				log.Errorf("%v", err)
+			}
+		}
+		if err := chain.Close(); err != nil {
+			log.Errorf("unable to close providers of Vault role '%s': %v", role, err)
+		}
+	}
+	c.chains = make(map[string]*secretschain.SecretChainStruct)
+}
+
+// queues the object by its namespace/name key
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Errorf("unable to queue %v: %v", obj, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// syncs next queued SecretSync, reports false when the queue is shut down
+func (c *Controller) processNext(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		c.queue.Forget(item)
+		return true
+	}
+	after, err := c.Reconcile(ctx, namespace, name)
+	if err != nil {
+		log.Errorf("unable to sync %s: %v", key, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+	c.queue.Forget(item)
+	if after > 0 {
+		c.queue.AddAfter(item, after)
+	}
+	return true
+}
+
+// Reconcile syncs SecretSync namespace/name into its Secret and updates its status.
+// Returns when it should be synced again, 0 means when its spec changes
+func (c *Controller) Reconcile(ctx context.Context, namespace, name string) (time.Duration, error) {
+	u, err := c.Dynamic.Resource(Resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return 0, nil // deleted, its Secret is garbage collected by the owner reference
+	}
+	if err != nil {
+		return 0, err
+	}
+	ss, err := fromUnstructured(u)
+	if err != nil {
+		return 0, err
+	}
+
+	interval, err := ss.RefreshInterval()
+	if err != nil {
+		return 0, c.setReady(ctx, ss, metav1.ConditionFalse, ReasonInvalidSpec, err.Error())
+	}
+	if err := c.Policy.Check(ss.Namespace, ss.Spec.Data); err != nil {
+		return 0, c.setReady(ctx, ss, metav1.ConditionFalse, ReasonForbidden, err.Error())
+	}
+	values, failed, err := c.Resolve(ss.Namespace, ss.Spec.Data)
+	if err != nil {
+		return 0, c.setReady(ctx, ss, metav1.ConditionFalse, ReasonInvalidSpec, err.Error())
+	}
+	if len(failed) > 0 { // the Secret keeps its last values
+		return c.RetryInterval, c.setReady(ctx, ss, metav1.ConditionFalse, ReasonResolveFailed, failedMessage(failed))
+	}
+
+	if err := c.applySecret(ctx, ss, values); err != nil {
+		if _, ok := err.(*conflictError); ok {
+			return c.RetryInterval, c.setReady(ctx, ss, metav1.ConditionFalse, ReasonSecretConflict, err.Error())
+		}
+		if serr := c.setReady(ctx, ss, metav1.ConditionFalse, ReasonUpdateFailed, err.Error()); serr != nil {
+			log.Errorf("unable to update status of %s/%s: %v", namespace, name, serr)
+		}
+		return 0, err
+	}
+	now := metav1.Now()
+	ss.Status.LastSyncTime = &now
+	msg := fmt.Sprintf("%d keys synced to Secret %s", len(values), ss.SecretName())
+	return interval, c.setReady(ctx, ss, metav1.ConditionTrue, ReasonSynced, msg)
+}
+
+// creates or updates Secret of the SecretSync with the values
+func (c *Controller) applySecret(ctx context.Context, ss *SecretSync, values map[string]string) error {
+	desired := secretsexport.NewKubernetesSecret(values, secretsexport.Options{Name: ss.SecretName(), Namespace: ss.Namespace})
+	if ss.Spec.Type != "" {
+		desired.Type = ss.Spec.Type
+	}
+	desired.Labels = map[string]string{ManagedByLabel: ManagedByValue}
+	desired.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(ss, Resource.GroupVersion().WithKind(Kind))}
+
+	secrets := c.Client.CoreV1().Secrets(ss.Namespace)
+	existing, err := secrets.Get(ctx, desired.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err := secrets.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		log.Infof("created Secret %s/%s", desired.Namespace, desired.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(existing, ss) { // never overwrite Secrets of others
+		return &conflictError{fmt.Sprintf("Secret %s exists and is not owned by %s %s", desired.Name, Kind, ss.Name)}
+	}
+	if existing.Type != desired.Type {
+		return &conflictError{fmt.Sprintf("type of Secret %s is %s and can't be changed to %s, delete the Secret", desired.Name, existing.Type, desired.Type)}
+	}
+	if reflect.DeepEqual(existing.Data, desired.Data) && existing.Labels[ManagedByLabel] == ManagedByValue {
+		return nil
+	}
+	existing.Data = desired.Data
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	existing.Labels[ManagedByLabel] = ManagedByValue
+	if _, err := secrets.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.Infof("updated Secret %s/%s", desired.Namespace, desired.Name)
+	return nil
+}
+
+// sets Ready condition and writes the status
+func (c *Controller) setReady(ctx context.Context, ss *SecretSync, status metav1.ConditionStatus, reason, message string) error {
+	ss.Status.ObservedGeneration = ss.Generation
+	ss.Status.SecretName = ss.SecretName()
+	meta.SetStatusCondition(&ss.Status.Conditions, metav1.Condition{
+		Type:               ConditionReady,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: ss.Generation,
+	})
+	if status != metav1.ConditionTrue {
+		log.Warningf("%s %s/%s: %s", Kind, ss.Namespace, ss.Name, message)
+	}
+	u, err := toUnstructured(ss)
+	if err != nil {
+		return err
+	}
+	_, err = c.Dynamic.Resource(Resource).Namespace(ss.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// returns message listing failed keys, sorted
+func failedMessage(failed map[string]error) string {
+	msgs := make([]string, 0, len(failed))
+	for key, err := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", key, err))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("%d keys failed: %s", len(failed), strings.Join(msgs, "; "))
+}
+
+// ResolveReferences resolves references with the secret providers of secretschain, configured with the
+// controller's environment like secret-injector itself, and Vault role of the namespace. Providers are kept
+// for the controller's lifetime, so syncs don't login to Vault again. Dynamic secrets are rejected, their leases
+// would outlive the sync
+func (c *Controller) ResolveReferences(namespace string, refs map[string]string) (map[string]string, map[string]error, error) {
+	chain, err := secretschain.NewSecretChainFromReferences(refs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range chain.Secrets {
+		if _, ok := s.Options[secinject.OptionDynamic]; ok {
+			return nil, nil, fmt.Errorf("dynamic secret of %s is not supported, its lease would outlive the sync", s.EnvVar)
+		}
+	}
+	role := ""
+	if c.Policy != nil {
+		role = c.Policy.Namespaces[namespace].VaultRole
+	}
+	shared, vaultErr := c.providers(role, chain.Secrets)
+	shared.Secrets = chain.Secrets
+	defer func() { shared.Secrets = nil }()
+
+	// without login of the role, Vault secrets fail instead of falling back to VAULT_ROLE
+	if err := shared.ResolveWhere(func(s *secretschain.SecretStruct) bool { return vaultErr == nil || !usesVault(s) }); err != nil {
+		log.Debugf("%v", err) // reported per key
+	}
+	failed := make(map[string]error)
+	for idx := range shared.Secrets {
+		s := &shared.Secrets[idx]
+		if vaultErr != nil && usesVault(s) {
+			s.Fail(vaultErr)
+		}
+		if s.Err != nil {
+			failed[s.EnvVar] = s.Err
+		}
+	}
+	c.keepTokenAlive(role, shared)
+	values, errs := shared.Environment()
+	if len(errs) > 0 {
+		msgs := []string{}
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, nil, fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return values, failed, nil
+}
+
+// returns chain holding providers of the Vault role, created on first use. Vault provider of a role other than
+// VAULT_ROLE is logged in here, if the secrets need it; the error is the failed login
+func (c *Controller) providers(role string, secrets []secretschain.SecretStruct) (*secretschain.SecretChainStruct, error) {
+	c.reauthenticate()
+	shared, ok := c.chains[role]
+	if !ok {
+		shared, _ = secretschain.NewSecretChainFromReferences(nil)
+		c.chains[role] = shared
+	}
+	if role == "" || shared.Provider(secretschain.HcVaultVarName) != nil {
+		return shared, nil
+	}
+	for idx := range secrets {
+		if usesVault(&secrets[idx]) {
+			hc := &secinject.HCVaultClientStruct{Role: role}
+			if err := hc.Init(); err != nil {
+				return shared, fmt.Errorf("unable to login to vault with role %s: %v", role, err)
+			}
+			shared.UseProvider(hc)
+			break
+		}
+	}
+	return shared, nil
+}
+
+// renews token of the Vault provider of the role's chain, if not renewed already. Providers whose token can't be
+// renewed anymore log in again before the next sync
+func (c *Controller) keepTokenAlive(role string, chain *secretschain.SecretChainStruct) {
+	hc, ok := chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct)
+	if !ok || hc.Leases == nil || hc.Leases.RenewsToken() {
+		return
+	}
+	hc.Leases.OnExpire(func(name string) {
+		if name == hcvault.TokenLeaseName {
+			c.expired.Add(role)
+		}
+	})
+	if err := hc.KeepTokenAlive(); err != nil {
+		log.Warningf("vault token will not be renewed: %v", err)
+	}
+}
+
+// logs in again with Vault providers of the roles whose token expired
+func (c *Controller) reauthenticate() {
+	for _, role := range c.expired.Take() {
+		chain, ok := c.chains[role]
+		if !ok {
+			continue // closed already
+		}
+		hc, ok := chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct)
+		if !ok {
+			continue
+		}
+		if err := hc.Reauthenticate(); err != nil {
+			log.Errorf("unable to re-authenticate to vault with role '%s': %v", role, err)
+		}
+	}
+}
+
+// reports whether the secret is resolved with the Vault provider
+func usesVault(s *secretschain.SecretStruct) bool {
+	return strings.EqualFold(s.Origin, secretschain.HcVaultVarName) || strings.EqualFold(s.Origin, secinject.TransitVarName)
+}
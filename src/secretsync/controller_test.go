@@ -0,0 +1,210 @@
+package secretsync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeVault resolves references from the map, references missing in it fail
+type fakeVault map[string]string
+
+func (v fakeVault) resolve(namespace string, refs map[string]string) (map[string]string, map[string]error, error) {
+	values, failed := map[string]string{}, map[string]error{}
+	for key, ref := range refs {
+		if ref == "invalid" {
+			return nil, nil, fmt.Errorf("invalid reference %s", ref)
+		}
+		if value, ok := v[ref]; ok {
+			values[key] = value
+		} else {
+			failed[key] = fmt.Errorf("secret '%s' not found in the vault", ref)
+		}
+	}
+	return values, failed, nil
+}
+
+func secretSync(name string, spec SecretSyncSpec) *unstructured.Unstructured {
+	ss := &SecretSync{
+		TypeMeta:   metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: Kind},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "apps", UID: types.UID("uid-" + name), Generation: 1},
+		Spec:       spec,
+	}
+	u, err := toUnstructured(ss)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func newController(vault fakeVault, objects ...runtime.Object) (*Controller, *kubefake.Clientset) {
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{Resource: Kind + "List"}, objects...)
+	client := kubefake.NewSimpleClientset()
+	c := New(dyn, client, "apps", &Policy{Namespaces: map[string]NamespacePolicy{
+		"apps": {Origins: []string{"hashicorpvault", "AzureKeyVault"}, PathPrefixes: []string{"secret/shared/", "api-key", "key"}},
+	}})
+	c.Resolve = vault.resolve
+	return c, client
+}
+
+// returns Ready condition of SecretSync apps/name
+func readyCondition(t *testing.T, c *Controller, name string) *metav1.Condition {
+	u, err := c.Dynamic.Resource(Resource).Namespace("apps").Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get %s: %v", name, err)
+	}
+	ss, err := fromUnstructured(u)
+	if err != nil {
+		t.Fatalf("unable to convert %s: %v", name, err)
+	}
+	cond := meta.FindStatusCondition(ss.Status.Conditions, ConditionReady)
+	if cond == nil {
+		t.Fatalf("%s has no Ready condition", name)
+	}
+	return cond
+}
+
+func TestReconcileCreatesAndUpdatesSecret(t *testing.T) {
+	t.Log("Testing Secret is created, owned by the SecretSync and updated")
+	vault := fakeVault{"secret/shared/db/mysql#password@hashicorpvault": "s3cr3t", "api-key@AzureKeyVault": "key1"}
+	c, client := newController(vault, secretSync("app", SecretSyncSpec{
+		SecretName:      "app-secrets",
+		RefreshInterval: "15m",
+		Data:            map[string]string{"DB_PASSWORD": "secret/shared/db/mysql#password@hashicorpvault", "api-key": "api-key@AzureKeyVault"},
+	}))
+	ctx := context.TODO()
+
+	after, err := c.Reconcile(ctx, "apps", "app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after != 15*time.Minute {
+		t.Errorf("expected refresh in 15m, got %s", after)
+	}
+	secret, err := client.CoreV1().Secrets("apps").Get(ctx, "app-secrets", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Secret was not created: %v", err)
+	}
+	if string(secret.Data["DB_PASSWORD"]) != "s3cr3t" || string(secret.Data["api-key"]) != "key1" || secret.Type != corev1.SecretTypeOpaque {
+		t.Errorf("unexpected Secret %+v", secret)
+	}
+	if ref := metav1.GetControllerOf(secret); ref == nil || ref.Kind != Kind || ref.Name != "app" {
+		t.Errorf("Secret should be controlled by the SecretSync, got %v", secret.OwnerReferences)
+	}
+	if secret.Labels[ManagedByLabel] != ManagedByValue {
+		t.Errorf("Secret should be labeled %s=%s", ManagedByLabel, ManagedByValue)
+	}
+	if cond := readyCondition(t, c, "app"); cond.Status != metav1.ConditionTrue || cond.Reason != ReasonSynced {
+		t.Errorf("unexpected condition %+v", cond)
+	}
+
+	t.Log("Testing rotated value is synced")
+	vault["api-key@AzureKeyVault"] = "key2"
+	if _, err := c.Reconcile(ctx, "apps", "app"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret, _ = client.CoreV1().Secrets("apps").Get(ctx, "app-secrets", metav1.GetOptions{})
+	if string(secret.Data["api-key"]) != "key2" {
+		t.Errorf("expected rotated value key2, got %s", secret.Data["api-key"])
+	}
+
+	t.Log("Testing failed resolution keeps last values")
+	delete(vault, "api-key@AzureKeyVault")
+	after, err = c.Reconcile(ctx, "apps", "app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after != DefaultRetryInterval {
+		t.Errorf("expected retry in %s, got %s", DefaultRetryInterval, after)
+	}
+	secret, _ = client.CoreV1().Secrets("apps").Get(ctx, "app-secrets", metav1.GetOptions{})
+	if string(secret.Data["api-key"]) != "key2" || string(secret.Data["DB_PASSWORD"]) != "s3cr3t" {
+		t.Errorf("Secret should keep its values, got %v", secret.Data)
+	}
+	if cond := readyCondition(t, c, "app"); cond.Status != metav1.ConditionFalse || cond.Reason != ReasonResolveFailed {
+		t.Errorf("unexpected condition %+v", cond)
+	}
+}
+
+func TestReconcileConflict(t *testing.T) {
+	t.Log("Testing Secret of others is not overwritten")
+	c, client := newController(fakeVault{"key@AzureKeyVault": "value"},
+		secretSync("app", SecretSyncSpec{Data: map[string]string{"key": "key@AzureKeyVault"}}))
+	ctx := context.TODO()
+	if _, err := client.CoreV1().Secrets("apps").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+		Data:       map[string][]byte{"key": []byte("mine")},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := c.Reconcile(ctx, "apps", "app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after != DefaultRetryInterval {
+		t.Errorf("expected retry in %s, got %s", DefaultRetryInterval, after)
+	}
+	secret, _ := client.CoreV1().Secrets("apps").Get(ctx, "app", metav1.GetOptions{})
+	if string(secret.Data["key"]) != "mine" {
+		t.Errorf("Secret of others was overwritten: %v", secret.Data)
+	}
+	if cond := readyCondition(t, c, "app"); cond.Status != metav1.ConditionFalse || cond.Reason != ReasonSecretConflict {
+		t.Errorf("unexpected condition %+v", cond)
+	}
+}
+
+func TestReconcileInvalidSpec(t *testing.T) {
+	t.Log("Testing invalid spec is reported and not retried")
+	c, client := newController(fakeVault{},
+		secretSync("interval", SecretSyncSpec{RefreshInterval: "often", Data: map[string]string{"key": "key@AzureKeyVault"}}),
+		secretSync("reference", SecretSyncSpec{Data: map[string]string{"key": "invalid"}}))
+	for _, name := range []string{"interval", "reference"} {
+		after, err := c.Reconcile(context.TODO(), "apps", name)
+		if err != nil || after != 0 {
+			t.Errorf("%s: expected no retry, got %s, %v", name, after, err)
+		}
+		if cond := readyCondition(t, c, name); cond.Status != metav1.ConditionFalse || cond.Reason != ReasonInvalidSpec {
+			t.Errorf("%s: unexpected condition %+v", name, cond)
+		}
+	}
+	if list, _ := client.CoreV1().Secrets("apps").List(context.TODO(), metav1.ListOptions{}); len(list.Items) != 0 {
+		t.Errorf("no Secret should be created, got %d", len(list.Items))
+	}
+
+	t.Log("Testing deleted SecretSync")
+	if after, err := c.Reconcile(context.TODO(), "apps", "deleted"); err != nil || after != 0 {
+		t.Errorf("expected nothing to do, got %s, %v", after, err)
+	}
+}
+
+func TestReconcileForbidden(t *testing.T) {
+	t.Log("Testing references not allowed by the policy are not resolved")
+	c, client := newController(fakeVault{"secret/other/db#password@hashicorpvault": "theirs", "key@file": "local"},
+		secretSync("path", SecretSyncSpec{Data: map[string]string{"key": "secret/other/db#password@hashicorpvault"}}),
+		secretSync("origin", SecretSyncSpec{Data: map[string]string{"key": "key@file"}}))
+	for _, name := range []string{"path", "origin"} {
+		after, err := c.Reconcile(context.TODO(), "apps", name)
+		if err != nil || after != 0 {
+			t.Errorf("%s: expected no retry, got %s, %v", name, after, err)
+		}
+		if cond := readyCondition(t, c, name); cond.Status != metav1.ConditionFalse || cond.Reason != ReasonForbidden {
+			t.Errorf("%s: unexpected condition %+v", name, cond)
+		}
+	}
+	if list, _ := client.CoreV1().Secrets("apps").List(context.TODO(), metav1.ListOptions{}); len(list.Items) != 0 {
+		t.Errorf("no Secret should be created, got %d", len(list.Items))
+	}
+}
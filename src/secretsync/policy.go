@@ -0,0 +1,138 @@
+// Module hosts the policy of the controller: what SecretSyncs of a namespace may resolve with the controller's identity
+//
+// Policy is YAML or JSON document, usually mounted from a ConfigMap (see setup/secretsync.yaml):
+//
+//   namespaces:
+//     apps:
+//       origins: [hashicorpvault, AzureKeyVault]
+//       pathPrefixes: [secret/apps, apps-api-key]
+//       vaultRole: secretsync-apps
+//
+// Namespaces which are not listed can't sync anything. Origins reading the controller's own filesystem or
+// namespace (file, dotenv, sops and kubernetes) are never allowed. Path prefixes match whole path elements:
+// secret/apps allows secret/apps/db but not secret/apps-other, so names without "/" (e.g. of Azure KeyVault)
+// are listed in full.
+//
+
+package secretsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"secretschain"
+	secinject "secretsinjector"
+)
+
+// Constants
+const (
+	PolicyFileVarName = "SECRETSYNC_POLICY_FILE" // path of the policy
+	ReasonForbidden   = "Forbidden"
+)
+
+// origins which are never allowed in controller mode: they read files, keys or Secrets of the controller itself
+var deniedOrigins = []string{secinject.FileVarName, secinject.DotenvVarName, secinject.SopsVarName, secinject.KubernetesVarName}
+
+// Policy lists what SecretSyncs may resolve, by namespace
+type Policy struct {
+	Namespaces map[string]NamespacePolicy `json:"namespaces"`
+}
+
+// NamespacePolicy is what SecretSyncs of one namespace may resolve
+type NamespacePolicy struct {
+	Origins      []string `json:"origins"`                // allowed origins, e.g. hashicorpvault
+	PathPrefixes []string `json:"pathPrefixes,omitempty"` // allowed prefixes of full paths (with Vault namespace, if any) by whole elements, any path if empty
+	VaultRole    string   `json:"vaultRole,omitempty"`    // Vault role to login with, VAULT_ROLE if empty
+}
+
+// LoadPolicy reads and validates policy file p
+func LoadPolicy(p string) (*Policy, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy %s: %v", p, err)
+	}
+	policy := &Policy{}
+	// strict, so misspelled fields are reported instead of silently ignored
+	if err := yaml.UnmarshalStrict(b, policy); err != nil {
+		return nil, fmt.Errorf("unable to parse policy %s: %v", p, err)
+	}
+	for namespace, np := range policy.Namespaces {
+		for _, origin := range np.Origins {
+			if isDenied(origin) {
+				return nil, fmt.Errorf("origin %s of namespace %s is not allowed in controller mode", origin, namespace)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Check returns error if references of a SecretSync in the namespace are not allowed by the policy.
+// Invalid references are left to the resolver
+func (p *Policy) Check(namespace string, refs map[string]string) error {
+	if p == nil {
+		return fmt.Errorf("no policy, namespace %s is not allowed to sync secrets", namespace)
+	}
+	np, ok := p.Namespaces[namespace]
+	if !ok {
+		return fmt.Errorf("namespace %s is not allowed to sync secrets, see %s", namespace, PolicyFileVarName)
+	}
+	chain, err := secretschain.NewSecretChainFromReferences(refs)
+	if err != nil {
+		return nil
+	}
+	for _, s := range chain.Secrets {
+		if isDenied(s.Origin) || !contains(np.Origins, s.Origin) {
+			return fmt.Errorf("origin %s of %s is not allowed in namespace %s", s.Origin, s.EnvVar, namespace)
+		}
+		if !np.allowsPath(secretPath(&s)) {
+			return fmt.Errorf("path %s of %s is not allowed in namespace %s", secretPath(&s), s.EnvVar, namespace)
+		}
+	}
+	return nil
+}
+
+// reports whether full path p is or is under a prefix of the policy, element by element. Paths with ".." never match
+func (np *NamespacePolicy) allowsPath(p string) bool {
+	for _, element := range strings.Split(p, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	if len(np.PathPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range np.PathPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// returns full path of the secret, prefixed with its Vault namespace, e.g. bu1/secret/apps/db
+func secretPath(s *secretschain.SecretStruct) string {
+	p := strings.TrimPrefix(s.VaultPath+s.Name, "/")
+	if ns := strings.Trim(s.Options[secinject.OptionNamespace], "/"); ns != "" {
+		p = ns + "/" + p
+	}
+	return p
+}
+
+// reports whether origin is never allowed in controller mode
+func isDenied(origin string) bool {
+	return contains(deniedOrigins, origin)
+}
+
+// reports whether list contains origin, case insensitive
+func contains(list []string, origin string) bool {
+	for _, o := range list {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
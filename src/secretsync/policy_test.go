@@ -0,0 +1,174 @@
+package secretsync
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"secretschain"
+	secinject "secretsinjector"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	t.Log("Testing references are checked against policy of the namespace")
+	policy := &Policy{Namespaces: map[string]NamespacePolicy{
+		"apps":  {Origins: []string{"hashicorpvault", "azurekeyvault"}, PathPrefixes: []string{"secret/apps/", "bu1/secret/apps", "apps-key"}},
+		"tools": {Origins: []string{"hashicorpvault", "file"}},
+	}}
+	cases := []struct {
+		namespace, ref string
+		allowed        bool
+	}{
+		{"apps", "secret/apps/db#password@hashicorpvault", true},
+		{"apps", "apps-key@AzureKeyVault", true},
+		{"apps", "secret/apps/db@hashicorpvault?namespace=bu1", true},
+		{"apps", "apps-key-other@AzureKeyVault", false},
+		{"apps", "secret/apps-other/db@hashicorpvault", false},
+		{"apps", "secret/apps-other/db@hashicorpvault?namespace=bu1", false},
+		{"apps", "secret/other/db#password@hashicorpvault", false},
+		{"apps", "secret/apps/../other/db@hashicorpvault", false},
+		{"apps", "secret/apps/db@hashicorpvault?namespace=bu2", false},
+		{"apps", "secret/apps/db@awsssm", false},
+		{"apps", "secret/apps/db.yaml@file", false},
+		{"apps", "web-tls/tls.crt@kubernetes", false},
+		{"tools", "secret/any/db@hashicorpvault", true},
+		{"tools", "db@file?path=/var/run/secrets/kubernetes.io/serviceaccount/token", false}, // even if listed
+		{"tools", "db.password@sops", false},
+		{"other", "secret/apps/db@hashicorpvault", false},
+	}
+	for _, c := range cases {
+		err := policy.Check(c.namespace, map[string]string{"KEY": c.ref})
+		if c.allowed && err != nil {
+			t.Errorf("%s %s: unexpected error: %v", c.namespace, c.ref, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("%s %s: expected error", c.namespace, c.ref)
+		}
+	}
+	var none *Policy
+	if err := none.Check("apps", map[string]string{"KEY": "secret/apps/db@hashicorpvault"}); err == nil {
+		t.Errorf("nothing should be allowed without policy")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	t.Log("Testing policy file")
+	dir, err := ioutil.TempDir("", "secretsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cases := map[string]string{
+		"valid.yaml":   "namespaces:\n  apps:\n    origins: [hashicorpvault]\n    pathPrefixes: [secret/apps/]\n    vaultRole: apps\n",
+		"denied.yaml":  "namespaces:\n  apps:\n    origins: [hashicorpvault, dotenv]\n",
+		"unknown.yaml": "namespaces:\n  apps:\n    origin: [hashicorpvault]\n",
+		"missing.yaml": "",
+	}
+	for name, content := range cases {
+		if content != "" {
+			ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		}
+		policy, err := LoadPolicy(filepath.Join(dir, name))
+		if name == "valid.yaml" {
+			if err != nil || policy.Namespaces["apps"].VaultRole != "apps" {
+				t.Errorf("%s: unexpected policy %+v (%v)", name, policy, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// counts requests of the Vault stub by method and path
+type vaultRequests struct {
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func TestResolveReferencesKeepsLogin(t *testing.T) {
+	t.Log("Testing providers and Vault login are kept between syncs")
+	requests := &vaultRequests{count: map[string]int{}}
+	responses := map[string]string{
+		"PUT /v1/auth/approle/login":     `{"auth":{"client_token":"s.apps","lease_duration":3600,"renewable":true}}`,
+		"PUT /v1/auth/token/renew-self":  `{"auth":{"client_token":"s.apps","lease_duration":3600,"renewable":true}}`,
+		"PUT /v1/auth/token/revoke-self": "",
+		"GET /v1/sys/mounts":             `{"data":{"secret/":{"type":"kv","options":{"version":"2"}}}}`,
+		"GET /v1/secret/data/apps/db":    `{"data":{"data":{"password":"s3cr3t"}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := r.Method + " " + r.URL.Path
+		requests.mu.Lock()
+		requests.count[req]++
+		requests.mu.Unlock()
+		resp, ok := responses[req]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		case resp == "":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(resp))
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "secretsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env := map[string]string{
+		"VAULT_ADDR":            server.URL,
+		"VAULT_AUTH_METHOD":     "approle",
+		"VAULT_APPROLE_ROLE_ID": "role-id",
+		"VAULT_TOKEN_PATH":      filepath.Join(dir, ".vault-token"),
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}()
+
+	c := New(nil, nil, "", &Policy{Namespaces: map[string]NamespacePolicy{"apps": {Origins: []string{"hashicorpvault"}, VaultRole: "apps"}}})
+	refs := map[string]string{"DB_PASSWORD": "secret/apps/db#password@hashicorpvault"}
+	for i := 0; i < 2; i++ {
+		values, failed, err := c.ResolveReferences("apps", refs)
+		if err != nil || len(failed) != 0 || values["DB_PASSWORD"] != "s3cr3t" {
+			t.Fatalf("unexpected values %v, failed %v (%v)", values, failed, err)
+		}
+	}
+	hc, ok := c.chains["apps"].Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct)
+	if !ok || hc.Role != "apps" || !hc.Leases.RenewsToken() {
+		t.Fatalf("expected renewed Vault provider of role apps, got %+v", c.chains)
+	}
+	if n := requests.count["PUT /v1/auth/approle/login"]; n != 1 {
+		t.Errorf("expected single login, got %d", n)
+	}
+	if n := requests.count["GET /v1/sys/mounts"]; n != 1 {
+		t.Errorf("kv client should be kept between syncs, got %d mounts lookups", n)
+	}
+
+	t.Log("Testing role whose token expired logs in again once, however often it was reported")
+	for _, role := range []string{"apps", "apps", "gone"} {
+		c.expired.Add(role)
+	}
+	if _, _, err := c.ResolveReferences("apps", refs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := requests.count["PUT /v1/auth/approle/login"]; n != 2 {
+		t.Errorf("expected login again after expiry, got %d logins", n)
+	}
+
+	c.Close()
+	if n := requests.count["PUT /v1/auth/token/revoke-self"]; n != 1 {
+		t.Errorf("token should be revoked on close, got %d revocations", n)
+	}
+}
@@ -0,0 +1,112 @@
+// Package secretsync implements controller which syncs vault secrets into native Kubernetes Secrets
+//
+// Secrets are declared with SecretSync custom resources (see setup/secretsync-crd.yaml):
+//
+//   apiVersion: secretsinjector.io/v1alpha1
+//   kind: SecretSync
+//   metadata:
+//     name: app-secrets
+//   spec:
+//     refreshInterval: 1h
+//     data:
+//       DB_PASSWORD: secret/shared/db/mysql#password@hashicorpvault
+//       api-key: api-key@AzureKeyVault
+//
+// References allowed by the policy of the namespace (see policy.go) are resolved by the secret providers of
+// secretschain. The Secret is owned by its SecretSync, refreshed every refreshInterval, and the outcome is
+// reported in the Ready condition of the status.
+//
+
+package secretsync
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Constants
+const (
+	Group                  = "secretsinjector.io"
+	Version                = "v1alpha1"
+	Kind                   = "SecretSync"
+	ConditionReady         = "Ready"
+	ReasonSynced           = "Synced"
+	ReasonInvalidSpec      = "InvalidSpec"
+	ReasonResolveFailed    = "ResolveFailed"
+	ReasonSecretConflict   = "SecretConflict"
+	ReasonUpdateFailed     = "UpdateFailed"
+	ManagedByLabel         = "app.kubernetes.io/managed-by"
+	ManagedByValue         = "secret-injector"
+	DefaultRefreshInterval = time.Hour
+)
+
+// Resource of SecretSync
+var Resource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "secretsyncs"}
+
+// SecretSync declares Secret with values from the vaults
+type SecretSync struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              SecretSyncSpec   `json:"spec"`
+	Status            SecretSyncStatus `json:"status,omitempty"`
+}
+
+// SecretSyncSpec is the desired Secret
+type SecretSyncSpec struct {
+	SecretName      string            `json:"secretName,omitempty"`      // name of the Secret, default is name of the SecretSync
+	Type            corev1.SecretType `json:"type,omitempty"`            // type of the Secret, default Opaque
+	RefreshInterval string            `json:"refreshInterval,omitempty"` // e.g. 15m, default 1h
+	Data            map[string]string `json:"data"`                      // key of the Secret -> secret reference, e.g. name#field@origin
+}
+
+// SecretSyncStatus is outcome of the last sync
+type SecretSyncStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	SecretName         string             `json:"secretName,omitempty"`
+	LastSyncTime       *metav1.Time       `json:"lastSyncTime,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// SecretName returns name of the synced Secret
+func (ss *SecretSync) SecretName() string {
+	if ss.Spec.SecretName != "" {
+		return ss.Spec.SecretName
+	}
+	return ss.Name
+}
+
+// RefreshInterval returns interval of refreshes
+func (ss *SecretSync) RefreshInterval() (time.Duration, error) {
+	if ss.Spec.RefreshInterval == "" {
+		return DefaultRefreshInterval, nil
+	}
+	d, err := time.ParseDuration(ss.Spec.RefreshInterval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid refreshInterval %s, expected duration like 15m", ss.Spec.RefreshInterval)
+	}
+	return d, nil
+}
+
+// converts unstructured object of the dynamic client into SecretSync
+func fromUnstructured(u *unstructured.Unstructured) (*SecretSync, error) {
+	ss := &SecretSync{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, ss); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// converts SecretSync into unstructured object of the dynamic client
+func toUnstructured(ss *SecretSync) (*unstructured.Unstructured, error) {
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ss)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: m}, nil
+}
@@ -0,0 +1,88 @@
+// Package supervisor runs the command as child process of secret-injector, instead of replacing it
+//
+// Signals received by the supervisor are forwarded to the child, orphaned processes are reaped when
+// running as PID 1 (the container entrypoint) and the exit code of the child is returned, so the caller
+// can clean up before it exits with the same code.
+//
+
+package supervisor
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supervisor of a child process
+type Supervisor struct {
+	Path string   // binary of the command
+	Args []string // arguments including the program name, as for syscall.Exec
+	Env  []string
+	Reap bool // reap every exited child, not just the command; needed as PID 1
+}
+
+// New returns Supervisor of the command, reaping orphans when running as PID 1
+func New(binary string, args, env []string) *Supervisor {
+	return &Supervisor{Path: binary, Args: args, Env: env, Reap: os.Getpid() == 1}
+}
+
+// Run starts the command and waits until it exits, returns its exit code (128+n when killed by signal n)
+func (s *Supervisor) Run() (int, error) {
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs) // all signals
+	defer signal.Stop(sigs)
+
+	p, err := os.StartProcess(s.Path, s.Args, &os.ProcAttr{Env: s.Env, Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to start process '%s'", s.Path)
+	}
+	log.Debugf("started process %s with pid %d", s.Path, p.Pid)
+
+	for {
+		if code, exited := s.reap(p.Pid); exited {
+			return code, nil
+		}
+		switch sig := <-sigs; sig {
+		case syscall.SIGCHLD: // reaped at the top of the loop
+		case syscall.SIGURG: // sent by go runtime to preempt goroutines
+		default:
+			log.Debugf("forwarding %s to process %d", sig, p.Pid)
+			if err := p.Signal(sig); err != nil {
+				log.Warningf("unable to forward %s to process %d: %v", sig, p.Pid, err)
+			}
+		}
+	}
+}
+
+// waits for exited children without blocking, reports whether child has exited and its exit code
+func (s *Supervisor) reap(child int) (int, bool) {
+	target := child
+	if s.Reap {
+		target = -1 // any child, orphans are re-parented to PID 1
+	}
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(target, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return 0, false
+		}
+		if pid == child {
+			return exitCode(ws), true
+		}
+		log.Debugf("reaped orphaned process %d", pid)
+	}
+}
+
+// returns exit code of the process, shells' convention 128+n for signal n
+func exitCode(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
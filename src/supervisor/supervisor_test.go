@@ -0,0 +1,52 @@
+package supervisor
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, script string) int {
+	s := New("/bin/sh", []string{"sh", "-c", script}, os.Environ())
+	code, err := s.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return code
+}
+
+func TestRunExitCode(t *testing.T) {
+	t.Log("Testing exit code of the child is returned")
+	if code := run(t, "exit 3"); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	if code := run(t, "true"); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+}
+
+func TestRunKilled(t *testing.T) {
+	t.Log("Testing child killed by signal")
+	if code := run(t, "kill -9 $$"); code != 128+9 {
+		t.Errorf("expected exit code 137, got %d", code)
+	}
+}
+
+func TestRunForwardsSignals(t *testing.T) {
+	t.Log("Testing signals are forwarded to the child")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	}()
+	if code := run(t, `trap "exit 7" USR1; while :; do sleep 0.05; done`); code != 7 {
+		t.Errorf("expected exit code 7 of the trap, got %d", code)
+	}
+}
+
+func TestRunMissingBinary(t *testing.T) {
+	t.Log("Testing missing binary")
+	if _, err := New("/nonexistent/binary", []string{"binary"}, nil).Run(); err == nil {
+		t.Errorf("expected error for missing binary")
+	}
+}
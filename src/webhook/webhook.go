@@ -0,0 +1,265 @@
+// Package webhook implements Kubernetes Mutating Admission Webhook which injects secret-injector into pods
+//
+// For every container referencing secrets (see secretschain.DetectSecretPattern) the webhook
+// adds in-memory volume, init container which copies secret-injector binary into that volume,
+// mounts the volume into the container and rewrites container's command to run secret-injector
+// with the original command as its arguments.
+//
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"secretschain"
+	"utils"
+)
+
+// Constants
+const (
+	InjectorVolumeName   = "secret-injector"
+	InjectorMountPath    = "/secret-injector"
+	InjectorBinaryPath   = "/usr/local/bin/secret-injector"
+	InitContainerName    = "secret-injector-init"
+	StatusAnnotation     = "secrets-injector/status"
+	StatusInjected       = "injected"
+	DefaultListenAddr    = ":8443"
+	DefaultCertFile      = "/etc/webhook/certs/tls.crt"
+	DefaultKeyFile       = "/etc/webhook/certs/tls.key"
+	DefaultInjectorImage = "secret-injector:latest"
+)
+
+// Config of the webhook server
+type Config struct {
+	ListenAddr      string
+	CertFile        string
+	KeyFile         string
+	Image           string // image of secret-injector used for init container
+	ImagePullPolicy corev1.PullPolicy
+}
+
+// NewConfigFromEnvironment returns webhook Config populated from env variables
+func NewConfigFromEnvironment() *Config {
+	c := &Config{
+		ListenAddr:      DefaultListenAddr,
+		CertFile:        DefaultCertFile,
+		KeyFile:         DefaultKeyFile,
+		Image:           DefaultInjectorImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+	}
+	if s := utils.GetEnvVariableByName("WEBHOOK_LISTEN_ADDR"); s != "" {
+		c.ListenAddr = s
+	}
+	if s := utils.GetEnvVariableByName("WEBHOOK_TLS_CERT_FILE"); s != "" {
+		c.CertFile = s
+	}
+	if s := utils.GetEnvVariableByName("WEBHOOK_TLS_KEY_FILE"); s != "" {
+		c.KeyFile = s
+	}
+	if s := utils.GetEnvVariableByName("SECRET_INJECTOR_IMAGE"); s != "" {
+		c.Image = s
+	}
+	if s := utils.GetEnvVariableByName("SECRET_INJECTOR_IMAGE_PULL_POLICY"); s != "" {
+		c.ImagePullPolicy = corev1.PullPolicy(s)
+	}
+	return c
+}
+
+// Server serves /mutate endpoint
+type Server struct {
+	Config *Config
+}
+
+// patchOperation is a single JSONPatch (RFC 6902) operation
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// NewServer returns new webhook Server
+func NewServer(c *Config) *Server {
+	if c == nil {
+		c = NewConfigFromEnvironment()
+	}
+	return &Server{Config: c}
+}
+
+// ListenAndServeTLS starts HTTPS server and blocks
+func (s *Server) ListenAndServeTLS() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", s.ServeMutate)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	log.Infof("webhook: listening on %s", s.Config.ListenAddr)
+	srv := &http.Server{Addr: s.Config.ListenAddr, Handler: mux}
+	return srv.ListenAndServeTLS(s.Config.CertFile, s.Config.KeyFile)
+}
+
+// ServeMutate handles AdmissionReview requests
+func (s *Server) ServeMutate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		http.Error(w, fmt.Sprintf("unsupported content type %q, expected application/json", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// v1 and v1beta1 reviews have the same fields, the response keeps apiVersion of the request
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		log.Errorf("webhook: unable to decode admission review: %v", err)
+		http.Error(w, "unable to decode admission review", http.StatusBadRequest)
+		return
+	}
+	if gv := review.APIVersion; gv != admissionv1.SchemeGroupVersion.String() && gv != v1beta1.SchemeGroupVersion.String() {
+		log.Errorf("webhook: unsupported admission review version %q", gv)
+		http.Error(w, fmt.Sprintf("unsupported admission review version %q", gv), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.Mutate(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	resp, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, "unable to encode admission review", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(resp)
+}
+
+// Mutate produces AdmissionResponse with JSONPatch for the pod in the request
+func (s *Server) Mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		log.Errorf("webhook: unable to decode pod: %v", err)
+		return &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
+	}
+	log.Debugf("webhook: reviewing pod %s/%s (%s)", req.Namespace, pod.Name, pod.GenerateName)
+
+	patch, err := s.createPatch(&pod)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
+	}
+	if len(patch) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	raw, err := json.Marshal(patch)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
+	}
+	pt := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{Allowed: true, Patch: raw, PatchType: &pt}
+}
+
+// createPatch builds JSONPatch operations to inject secret-injector into the pod
+func (s *Server) createPatch(pod *corev1.Pod) ([]patchOperation, error) {
+	patch := []patchOperation{}
+	if pod.Annotations[StatusAnnotation] == StatusInjected {
+		return patch, nil // already done
+	}
+
+	mount := corev1.VolumeMount{Name: InjectorVolumeName, MountPath: InjectorMountPath}
+	injected := 0
+	for idx, c := range pod.Spec.Containers {
+		if !requiresInjection(&c) {
+			continue
+		}
+		if len(c.Command) == 0 {
+			// we don't inspect images, so without command the entrypoint is unknown
+			return nil, errors.Errorf("container %q references secrets but has no command, can't determine the entrypoint - please specify it explicitly", c.Name)
+		}
+		base := fmt.Sprintf("/spec/containers/%d", idx)
+		patch = append(patch, addToList(base+"/volumeMounts", len(c.VolumeMounts) == 0, mount))
+		patch = append(patch, patchOperation{
+			Op:    "replace",
+			Path:  base + "/command",
+			Value: []string{path.Join(InjectorMountPath, path.Base(InjectorBinaryPath))},
+		})
+		patch = append(patch, patchOperation{
+			Op:    addOrReplace(len(c.Args) == 0),
+			Path:  base + "/args",
+			Value: append(append([]string{}, c.Command...), c.Args...),
+		})
+		injected++
+	}
+	if injected == 0 {
+		return patch, nil
+	}
+
+	volume := corev1.Volume{
+		Name: InjectorVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory},
+		},
+	}
+	initContainer := corev1.Container{
+		Name:            InitContainerName,
+		Image:           s.Config.Image,
+		ImagePullPolicy: s.Config.ImagePullPolicy,
+		Command:         []string{"sh", "-c", fmt.Sprintf("cp %s %s/", InjectorBinaryPath, InjectorMountPath)},
+		VolumeMounts:    []corev1.VolumeMount{mount},
+	}
+	patch = append(patch, addToList("/spec/volumes", len(pod.Spec.Volumes) == 0, volume))
+	patch = append(patch, addToList("/spec/initContainers", len(pod.Spec.InitContainers) == 0, initContainer))
+
+	if pod.Annotations == nil {
+		patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{StatusAnnotation: StatusInjected}})
+	} else {
+		patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(StatusAnnotation), Value: StatusInjected})
+	}
+	log.Infof("webhook: injecting secret-injector into %d container(s) of pod %s", injected, pod.Name)
+	return patch, nil
+}
+
+// requiresInjection checks container's env section for secret references
+func requiresInjection(c *corev1.Container) bool {
+	for _, e := range c.Env {
+		if secretschain.DetectSecretPattern(e.Name, e.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// addToList appends value to the list at path p, creating the list if it's empty
+func addToList(p string, empty bool, value interface{}) patchOperation {
+	if empty {
+		return patchOperation{Op: "add", Path: p, Value: []interface{}{value}}
+	}
+	return patchOperation{Op: "add", Path: p + "/-", Value: value}
+}
+
+func addOrReplace(empty bool) string {
+	if empty {
+		return "add"
+	}
+	return "replace"
+}
+
+// escapeJSONPointer escapes reference token as per RFC 6901
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+
+	_ "secretsinjector" // registers origins recognised in pod env
+)
+
+func loadReview(t *testing.T) []byte {
+	b, err := ioutil.ReadFile("testdata/admission-review.json")
+	if err != nil {
+		t.Fatalf("unable to read recorded admission review: %v", err)
+	}
+	return b
+}
+
+func TestServeMutate(t *testing.T) {
+	t.Log("Testing /mutate with recorded AdmissionReview")
+	s := NewServer(&Config{Image: "registry/secret-injector:v1", ImagePullPolicy: "Always"})
+
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(loadReview(t)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.ServeMutate(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	review := v1beta1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	if review.Response == nil || !review.Response.Allowed {
+		t.Fatalf("expected pod to be allowed: %+v", review.Response)
+	}
+	if review.Response.UID != "0df28fbd-5f5f-11e9-9d4f-0a58ac1f0b12" {
+		t.Errorf("response UID does not match request UID: %s", review.Response.UID)
+	}
+	if review.Response.PatchType == nil || *review.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+		t.Fatalf("expected JSONPatch patch type")
+	}
+
+	patch := []patchOperation{}
+	if err := json.Unmarshal(review.Response.Patch, &patch); err != nil {
+		t.Fatalf("unable to decode patch: %v", err)
+	}
+	ops := make(map[string]patchOperation)
+	for _, p := range patch {
+		ops[p.Path] = p
+	}
+
+	if p, ok := ops["/spec/containers/0/command"]; !ok || p.Op != "replace" {
+		t.Errorf("container 'app' command was not replaced: %v", patch)
+	} else if cmd := p.Value.([]interface{}); len(cmd) != 1 || cmd[0] != "/secret-injector/secret-injector" {
+		t.Errorf("unexpected command: %v", cmd)
+	}
+	if p, ok := ops["/spec/containers/0/args"]; !ok {
+		t.Errorf("container 'app' args were not set")
+	} else if args := p.Value.([]interface{}); len(args) != 3 || args[0] != "/my-application-script.sh" || args[2] != "8080" {
+		t.Errorf("original command should be passed as arguments: %v", args)
+	}
+	if _, ok := ops["/spec/containers/0/volumeMounts/-"]; !ok {
+		t.Errorf("injector volume was not mounted into container 'app'")
+	}
+	if _, ok := ops["/spec/volumes/-"]; !ok {
+		t.Errorf("injector volume was not added")
+	}
+	if p, ok := ops["/spec/initContainers"]; !ok {
+		t.Errorf("init container was not added")
+	} else {
+		c := p.Value.([]interface{})[0].(map[string]interface{})
+		if c["image"] != "registry/secret-injector:v1" || c["name"] != InitContainerName {
+			t.Errorf("unexpected init container: %v", c)
+		}
+	}
+	if _, ok := ops["/metadata/annotations"]; !ok {
+		t.Errorf("status annotation was not added")
+	}
+	for p := range ops {
+		if p == "/spec/containers/1/command" || p == "/spec/containers/1/volumeMounts" {
+			t.Errorf("container 'log-shipper' has no secrets and must not be patched")
+		}
+	}
+}
+
+func TestServeMutateV1(t *testing.T) {
+	t.Log("Testing /mutate answers admission.k8s.io/v1 AdmissionReview in the same version")
+	body := strings.Replace(string(loadReview(t)), `"admission.k8s.io/v1beta1"`, `"admission.k8s.io/v1"`, 1)
+	req := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	NewServer(&Config{Image: "registry/secret-injector:v1"}).ServeMutate(rec, req)
+
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s (%v)", rec.Code, rec.Body.String(), err)
+	}
+	if review.APIVersion != "admission.k8s.io/v1" || review.Kind != "AdmissionReview" {
+		t.Errorf("response should be admission.k8s.io/v1 AdmissionReview, got %s %s", review.APIVersion, review.Kind)
+	}
+	if review.Response == nil || !review.Response.Allowed || review.Response.UID != "0df28fbd-5f5f-11e9-9d4f-0a58ac1f0b12" || len(review.Response.Patch) == 0 {
+		t.Errorf("expected allowed pod with patch: %+v", review.Response)
+	}
+
+	body = strings.Replace(body, `"admission.k8s.io/v1"`, `"admission.k8s.io/v2"`, 1)
+	req = httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	NewServer(&Config{}).ServeMutate(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown review version should be rejected, got status %d", rec.Code)
+	}
+}
+
+func TestMutateSkipsInjectedPod(t *testing.T) {
+	t.Log("Testing that already injected pods are left alone")
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(loadReview(t), &review); err != nil {
+		t.Fatalf("unable to decode recorded review: %v", err)
+	}
+	pod := make(map[string]interface{})
+	_ = json.Unmarshal(review.Request.Object.Raw, &pod)
+	pod["metadata"].(map[string]interface{})["annotations"] = map[string]string{StatusAnnotation: StatusInjected}
+	review.Request.Object.Raw, _ = json.Marshal(pod)
+
+	resp := NewServer(&Config{}).Mutate(review.Request)
+	if !resp.Allowed || resp.Patch != nil {
+		t.Errorf("expected no patch for already injected pod, got: %s", string(resp.Patch))
+	}
+}
+
+func TestServeMutateRejectsWrongContentType(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(loadReview(t)))
+	req.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	NewServer(&Config{}).ServeMutate(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415, got %d", rec.Code)
+	}
+}
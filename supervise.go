@@ -0,0 +1,93 @@
+// Supervise mode: the command runs as child of secret-injector instead of replacing it (syscall.Exec), so
+// leases are renewed while it runs and cleanup hooks run when it exits: leases and the vault token are
+// revoked and secret files are wiped. The exit code of the command is propagated.
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"secretschain"
+	secinject "secretsinjector"
+	"supervisor"
+	"utils"
+)
+
+const (
+	superviseVarName   = "SECRET_INJECTOR_SUPERVISE"
+	revokeTokenVarName = "SECRET_INJECTOR_REVOKE_TOKEN" // default true in supervise mode
+	wipeFilesVarName   = "SECRET_INJECTOR_WIPE_FILES"   // default true in supervise mode
+)
+
+var supervise = flag.Bool("supervise", false, "run the command as child process and clean up when it exits, same as env variable "+superviseVarName+"=true")
+
+// reports whether the command should be supervised instead of exec'd
+func superviseMode() bool {
+	return *supervise || envBool(superviseVarName, false)
+}
+
+// returns boolean env variable, or def if not set or invalid
+func envBool(name string, def bool) bool {
+	v := utils.GetEnvVariableByName(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warningf("%s invalid value %s of %s, using %t", logPrefix, v, name, def)
+		return def
+	}
+	return b
+}
+
+// Runs the command as child process, then the cleanup hooks, and exits with the exit code of the command
+func runSupervised(chain *secretschain.SecretChainStruct, binary string, args []string) {
+	hooks := cleanupHooks(chain)
+	log.Infof("starting supervised process %s %v", binary, args)
+	code, err := supervisor.New(binary, args, os.Environ()).Run()
+	if err != nil {
+		log.Errorf("%s %v", logPrefix, err)
+		code = 127
+	}
+	log.Infof("%s process %s exited with code %d", logPrefix, binary, code)
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			log.Errorf("%s cleanup failed: %v", logPrefix, err)
+		}
+	}
+	os.Exit(code)
+}
+
+// returns cleanup hooks in the order they run: leases, token, files
+func cleanupHooks(chain *secretschain.SecretChainStruct) []func() error {
+	hc, _ := chain.Provider(secretschain.HcVaultVarName).(*secinject.HCVaultClientStruct) // Close forgets providers
+	hooks := []func() error{chain.Close}                                                  // revokes leases of dynamic secrets
+	if hc != nil && envBool(revokeTokenVarName, true) {
+		hooks = append(hooks, hc.RevokeToken)
+	}
+	if envBool(wipeFilesVarName, true) {
+		hooks = append(hooks, func() error { return wipeSecretFiles(chain) })
+	}
+	return hooks
+}
+
+// removes secret files written for the chain
+func wipeSecretFiles(chain *secretschain.SecretChainStruct) error {
+	var first error
+	for idx := range chain.Secrets {
+		for name := range secretFiles(&chain.Secrets[idx]) {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				log.Errorf("%s unable to wipe secret file %s: %v", logPrefix, name, err)
+				if first == nil {
+					first = err
+				}
+				continue
+			}
+			log.Debugf("%s secret file %s wiped", logPrefix, name)
+		}
+	}
+	return first
+}